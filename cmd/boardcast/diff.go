@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffEdits bounds the work done by diffLines. Inputs that differ by more
+// lines than this are reported as a whole-text replacement instead.
+const maxDiffEdits = 2000
+
+type diffLine struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns a line-based unified diff turning a into b, with three
+// lines of context around each change, or "" when they are equal.
+func unifiedDiff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	// aPos[i] and bPos[i] count the lines of a and b before ops[i].
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	for i, prevEnd := 0, 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		start := max(i-context, prevEnd)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			j := end
+			for j < len(ops) && ops[j].kind == ' ' {
+				j++
+			}
+			if j == len(ops) || j-end > 2*context {
+				end = min(end+context, len(ops))
+				break
+			}
+			end = j
+		}
+
+		aStart, aLen := aPos[start], aPos[end]-aPos[start]
+		bStart, bLen := bPos[start], bPos[end]-bPos[start]
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.text)
+			out.WriteByte('\n')
+		}
+
+		prevEnd, i = end, end
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines computes a shortest edit script from a to b with Myers'
+// algorithm, after trimming the common prefix and suffix.
+func diffLines(a, b []string) []diffLine {
+	var prefix, suffix []diffLine
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		prefix = append(prefix, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suffix = append(suffix, diffLine{' ', a[len(a)-1]})
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	ops := append(prefix, myers(a, b)...)
+	for i := len(suffix) - 1; i >= 0; i-- {
+		ops = append(ops, suffix[i])
+	}
+	return ops
+}
+
+func myers(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxDiffEdits)
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+
+	// trace[d] holds v[-d..d] as it was before round d, for backtracking.
+	var trace [][]int
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		ops := make([]diffLine, 0, n+m)
+		for _, line := range a {
+			ops = append(ops, diffLine{'-', line})
+		}
+		for _, line := range b {
+			ops = append(ops, diffLine{'+', line})
+		}
+		return ops
+	}
+
+	var rev []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			rev = append(rev, diffLine{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			rev = append(rev, diffLine{'+', b[y-1]})
+			y--
+		} else {
+			rev = append(rev, diffLine{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		rev = append(rev, diffLine{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	ops := make([]diffLine, len(rev))
+	for i, op := range rev {
+		ops[len(rev)-1-i] = op
+	}
+	return ops
+}
+
+// deltaOp is one step of a history entry stored as a delta: keep or delete
+// lines of the version it is based on, or insert text.
+type deltaOp struct {
+	Keep   int    `json:"k,omitempty"`
+	Delete int    `json:"d,omitempty"`
+	Insert string `json:"i,omitempty"`
+}
+
+// lineDelta returns the edits turning a into b. Lines keep their newlines,
+// so applyDelta rebuilds b byte for byte.
+func lineDelta(a, b string) []deltaOp {
+	var ops []deltaOp
+	for _, line := range diffLines(strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n")) {
+		var last *deltaOp
+		if len(ops) > 0 {
+			last = &ops[len(ops)-1]
+		}
+		switch {
+		case line.kind == ' ' && last != nil && last.Keep > 0:
+			last.Keep++
+		case line.kind == ' ':
+			ops = append(ops, deltaOp{Keep: 1})
+		case line.kind == '-' && last != nil && last.Delete > 0:
+			last.Delete++
+		case line.kind == '-':
+			ops = append(ops, deltaOp{Delete: 1})
+		case last != nil && last.Insert != "":
+			last.Insert += line.text
+		default:
+			ops = append(ops, deltaOp{Insert: line.text})
+		}
+	}
+	return ops
+}
+
+// applyDelta applies ops from lineDelta to the version they were computed
+// against.
+func applyDelta(base string, ops []deltaOp) (string, error) {
+	lines := strings.SplitAfter(base, "\n")
+	var out strings.Builder
+	pos := 0
+	for _, op := range ops {
+		if pos+op.Keep+op.Delete > len(lines) {
+			return "", fmt.Errorf("delta runs past the end of its base (%d lines)", len(lines))
+		}
+		for _, line := range lines[pos : pos+op.Keep] {
+			out.WriteString(line)
+		}
+		pos += op.Keep + op.Delete
+		out.WriteString(op.Insert)
+	}
+	return out.String(), nil
+}
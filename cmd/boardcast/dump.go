@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// dumpFormat is the version of the dump format written by boardcast
+// export. boardcast import refuses dumps with a newer version.
+const dumpFormat = 1
+
+// dump is a whole board as written by boardcast export: tabs, active and
+// archived, with their history, snapshots and templates. Images are not
+// included.
+type dump struct {
+	Format    int              `json:"format"`
+	Exported  time.Time        `json:"exported"`
+	Tabs      []*Tab           `json:"tabs"`
+	History   []HistoryRecord  `json:"history"`
+	Snapshots []SnapshotRecord `json:"snapshots"`
+	Templates []TemplateRecord `json:"templates"`
+}
+
+// runSubcommand runs a one-shot command given as the first argument
+// instead of the server, and reports whether there was one.
+func runSubcommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	var err error
+	switch args[0] {
+	case "export":
+		err = runExport(args[1:])
+	case "import":
+		err = runImport(args[1:])
+	default:
+		return false
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+	return true
+}
+
+// dumpFlags returns a flag set for export or import. Flags shared with the
+// server set the same variables, so storage is opened the same way.
+func dumpFlags(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: boardcast %s\n", usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(dataDir, "data-dir", *dataDir, "Data directory containing boardcast.db")
+	fs.StringVar(encKeyFile, "encryption-key-file", *encKeyFile, "Path to the at-rest encryption key, if the database is encrypted (or set BOARDCAST_ENCRYPTION_KEY)")
+	return fs
+}
+
+// runExport writes the database in --data-dir to --out as JSON. The
+// database is opened read-only and may be in use by a running server.
+func runExport(args []string) error {
+	fs := dumpFlags("export", "export [--data-dir DIR] [--out FILE]")
+	out := fs.String("out", "", "File to write the dump to (default: standard output)")
+	fs.Parse(args)
+
+	storage, err := OpenStorageReadOnly(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	key, err := encryptionKey()
+	if err != nil {
+		return err
+	}
+	if err := storage.setEncryptionKey(key); err != nil {
+		return err
+	}
+
+	d := dump{Format: dumpFormat, Exported: time.Now()}
+	active, err := storage.LoadTabs()
+	if err != nil {
+		return err
+	}
+	archived, err := storage.LoadArchivedTabs()
+	if err != nil {
+		return err
+	}
+	d.Tabs = append(active, archived...)
+	for _, tab := range d.Tabs {
+		err := storage.EachHistory(tab.ID, func(rec HistoryRecord) error {
+			d.History = append(d.History, rec)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("history of tab %s: %w", tab.ID, err)
+		}
+	}
+	if d.Snapshots, err = storage.GetSnapshots(-1); err != nil {
+		return err
+	}
+	if d.Templates, err = storage.GetTemplates(); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := json.NewEncoder(w).Encode(d); err != nil {
+		return err
+	}
+	log.Printf("Exported %d tabs, %d history entries, %d snapshots and %d templates", len(d.Tabs), len(d.History), len(d.Snapshots), len(d.Templates))
+	return nil
+}
+
+// runImport loads a dump from boardcast export into the database in
+// --data-dir, which must have no tabs or snapshots yet. The server must not
+// be running on it.
+func runImport(args []string) error {
+	fs := dumpFlags("import", "import [--data-dir DIR] [--in FILE]")
+	in := fs.String("in", "", "File to read the dump from (default: standard input)")
+	fs.StringVar(encScope, "encryption-scope", *encScope, "What to encrypt with a key: all, or only tabs marked encrypted (tabs)")
+	fs.BoolVar(historyDiffs, "history-diffs", *historyDiffs, "Store imported history as diffs where the server would")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var d dump
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return fmt.Errorf("decode dump: %w", err)
+	}
+	if d.Format > dumpFormat {
+		return fmt.Errorf("dump format %d is newer than this build supports (%d); upgrade boardcast", d.Format, dumpFormat)
+	}
+
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		return err
+	}
+	storage, err := NewStorage(*dataDir, sqlitePragmas()...)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	key, err := encryptionKey()
+	if err != nil {
+		return err
+	}
+	storage.encryptAll = *encScope != "tabs"
+	storage.historyDiffs = *historyDiffs
+	if err := storage.setEncryptionKey(key); err != nil {
+		return err
+	}
+
+	tabs, err := storage.queryTabs("")
+	if err != nil {
+		return err
+	}
+	snapshots, err := storage.CountSnapshots()
+	if err != nil {
+		return err
+	}
+	if len(tabs) > 0 || snapshots > 0 {
+		return errors.New("the database already has tabs or snapshots; import into an empty data directory")
+	}
+
+	history := make(map[string][]HistoryRecord)
+	for _, rec := range d.History {
+		history[rec.TabID] = append(history[rec.TabID], rec)
+	}
+	for _, tab := range d.Tabs {
+		if err := storage.ImportTab(tab); err != nil {
+			return fmt.Errorf("tab %s: %w", tab.ID, err)
+		}
+		if err := storage.ImportHistory(tab.ID, history[tab.ID]); err != nil {
+			return fmt.Errorf("history of tab %s: %w", tab.ID, err)
+		}
+	}
+	// Snapshots are exported newest first; insert oldest first.
+	for i := len(d.Snapshots) - 1; i >= 0; i-- {
+		rec := d.Snapshots[i]
+		if err := storage.ImportSnapshot(rec); err != nil {
+			return fmt.Errorf("snapshot %q: %w", rec.Name, err)
+		}
+	}
+	for _, tpl := range d.Templates {
+		if err := storage.SaveTemplate(tpl.Name, tpl.Content); err != nil {
+			return fmt.Errorf("template %q: %w", tpl.Name, err)
+		}
+	}
+	log.Printf("Imported %d tabs, %d history entries, %d snapshots and %d templates", len(d.Tabs), len(d.History), len(d.Snapshots), len(d.Templates))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// encryptedPrefix marks column values sealed by Storage.seal. Values without
+// it are plaintext, so encryption can be turned on for an existing database:
+// rows are encrypted as they are next written.
+const encryptedPrefix = "boardcast:aes-gcm:"
+
+var errNoKey = errors.New("database contains encrypted data; set --encryption-key-file or BOARDCAST_ENCRYPTION_KEY")
+
+// encryptionKey returns the at-rest encryption key from
+// BOARDCAST_ENCRYPTION_KEY or --encryption-key-file, or nil when encryption
+// is disabled. The key is 32 bytes, written as hex or base64.
+func encryptionKey() ([]byte, error) {
+	text := os.Getenv("BOARDCAST_ENCRYPTION_KEY")
+	if text == "" && *encKeyFile != "" {
+		data, err := os.ReadFile(*encKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read encryption key file: %w", err)
+		}
+		text = string(data)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(text)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes, hex or base64 encoded (e.g. openssl rand -hex 32)")
+	}
+	return key, nil
+}
+
+// setEncryptionKey enables AES-256-GCM encryption of stored content, or
+// leaves it off for a nil key. It checks that the key opens data already
+// encrypted in the database, so a wrong or missing key fails at startup
+// instead of on first read.
+func (s *Storage) setEncryptionKey(key []byte) error {
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		s.aead = aead
+	}
+
+	var sample string
+	err := s.db.QueryRow("SELECT content FROM tabs WHERE substr(content, 1, ?) = ? LIMIT 1", len(encryptedPrefix), encryptedPrefix).Scan(&sample)
+	if err != nil {
+		return nil // nothing encrypted yet
+	}
+	if _, err := s.open(sample); err != nil {
+		if s.aead == nil {
+			return errNoKey
+		}
+		return errors.New("encryption key does not match the data in the database")
+	}
+	return nil
+}
+
+// seal encrypts a TEXT column value when encryption is enabled for all
+// data rather than per tab (--encryption-scope=all).
+func (s *Storage) seal(plain string) string {
+	return s.sealIf(s.encryptAll, plain)
+}
+
+// sealIf is seal for values encrypted only when encrypt is set, such as the
+// content of tabs marked encrypted.
+func (s *Storage) sealIf(encrypt bool, plain string) string {
+	if s.aead == nil || !encrypt {
+		return plain
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(s.encrypt([]byte(plain)))
+}
+
+// open decrypts a value written by seal and returns plaintext values as
+// they are.
+func (s *Storage) open(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		return stored, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored[len(encryptedPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("decrypt: %w", err)
+	}
+	plain, err := s.decrypt(sealed)
+	return string(plain), err
+}
+
+// sealBytes is seal for BLOB columns.
+func (s *Storage) sealBytes(plain []byte) []byte {
+	if s.aead == nil || !s.encryptAll {
+		return plain
+	}
+	return append([]byte(encryptedPrefix), s.encrypt(plain)...)
+}
+
+func (s *Storage) openBytes(stored []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, []byte(encryptedPrefix)) {
+		return stored, nil
+	}
+	return s.decrypt(stored[len(encryptedPrefix):])
+}
+
+// tabEncrypted reports whether content of tabID is written encrypted:
+// always with --encryption-scope=all, otherwise when the tab is marked
+// encrypted. It is false without a key.
+func (s *Storage) tabEncrypted(tabID string) bool {
+	if s.aead == nil || s.encryptAll {
+		return s.aead != nil
+	}
+	var encrypted bool
+	s.db.QueryRow("SELECT encrypted FROM tabs WHERE id = ?", tabID).Scan(&encrypted)
+	return encrypted
+}
+
+// encrypt returns a random nonce followed by the ciphertext.
+func (s *Storage) encrypt(plain []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	rand.Read(nonce)
+	return s.aead.Seal(nonce, nonce, plain, nil)
+}
+
+func (s *Storage) decrypt(sealed []byte) ([]byte, error) {
+	if s.aead == nil {
+		return nil, errNoKey
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("decrypt: value too short")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// upstreamPassword returns the password used to log in to the primary,
+// from BOARDCAST_UPSTREAM_PASSWORD or --upstream-password-file.
+func upstreamPassword() string {
+	if env := os.Getenv("BOARDCAST_UPSTREAM_PASSWORD"); env != "" {
+		return env
+	}
+	if *upstreamPass != "" {
+		data, err := os.ReadFile(*upstreamPass)
+		if err != nil {
+			log.Fatalf("Failed to read upstream password file: %v", err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return ""
+}
+
+// follow mirrors the primary at upstream into hub. Every message received
+// from the primary, starting with its init, is fed through the hub as if a
+// local client had sent it. The connection is re-established with backoff
+// whenever it drops.
+func follow(hub *Hub, upstream, pwd string) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := followOnce(hub, upstream, pwd)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Upstream %s: %v; reconnecting in %s", upstream, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func followOnce(hub *Hub, upstream, pwd string) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+
+	session, err := upstreamLogin(u, pwd)
+	if err != nil {
+		return err
+	}
+
+	// The mirror needs every tab's content, whatever the primary's
+	// --init-mode.
+	q := u.Query()
+	q.Set("init", "full")
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Cookie", (&http.Cookie{Name: "session_id", Value: session}).String())
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("Following upstream %s", upstream)
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		hub.enqueue(message)
+	}
+}
+
+// upstreamLogin authenticates against the primary's /api/auth and returns
+// the session ID from the response cookie.
+func upstreamLogin(ws *url.URL, pwd string) (string, error) {
+	auth := *ws
+	auth.Path = "/api/auth"
+	auth.RawQuery = ""
+	switch ws.Scheme {
+	case "ws":
+		auth.Scheme = "http"
+	case "wss":
+		auth.Scheme = "https"
+	default:
+		return "", fmt.Errorf("upstream URL must use ws:// or wss://")
+	}
+
+	body, _ := json.Marshal(map[string]string{"password": pwd})
+	resp, err := http.Post(auth.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream login: %s", resp.Status)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session_id" {
+			return cookie.Value, nil
+		}
+	}
+	return "", fmt.Errorf("upstream login: no session cookie")
+}
+
+// followerMiddleware refuses requests that would mutate the mirrored board;
+// edits must be made on the primary. Logging in and out and disconnecting
+// local viewers still work.
+func followerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET", r.Method == "HEAD", r.Method == "OPTIONS":
+		case r.URL.Path == "/api/auth", strings.HasPrefix(r.URL.Path, "/api/clients/"):
+		default:
+			http.Error(w, "Read-only follower; send changes to the primary", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
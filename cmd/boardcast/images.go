@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxImagePixels is the most pixels an uploaded raster image may have.
+// Decoding needs four bytes a pixel, and resizing as much again, so a small
+// file declaring huge dimensions could otherwise exhaust memory.
+const maxImagePixels = 50_000_000
+
+// tooManyPixels reports whether an image's declared size is over
+// maxImagePixels.
+func tooManyPixels(cfg image.Config) bool {
+	return int64(cfg.Width)*int64(cfg.Height) > maxImagePixels
+}
+
+// checkImagePixels returns an error for a raster image over
+// maxImagePixels. Data it can't read the size of passes.
+func checkImagePixels(data []byte) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil && tooManyPixels(cfg) {
+		return fmt.Errorf("%dx%d pixels is over the limit of %d", cfg.Width, cfg.Height, maxImagePixels)
+	}
+	return nil
+}
+
+// downscaleImage shrinks PNG and JPEG images whose width or height exceeds
+// maxDim, preserving the aspect ratio. It returns the re-encoded data and
+// its format, or ok=false when the image is within bounds or is not a
+// format we re-encode (GIFs are skipped so animations survive).
+func downscaleImage(data []byte, maxDim int) (resized []byte, format string, ok bool) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") || tooManyPixels(cfg) {
+		return nil, "", false
+	}
+	if cfg.Width <= maxDim && cfg.Height <= maxDim {
+		return nil, "", false
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false
+	}
+
+	dst := boxResize(src, maxDim)
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, "", false
+	}
+	return buf.Bytes(), format, true
+}
+
+// allowedTypes holds the MIME types accepted for uploads, from
+// --allowed-image-types.
+var allowedTypes map[string]bool
+
+// parseImageTypes parses a comma-separated list of MIME types.
+func parseImageTypes(list string) map[string]bool {
+	types := make(map[string]bool)
+	for _, t := range splitList(list) {
+		types[strings.ToLower(t)] = true
+	}
+	return types
+}
+
+// sniffImageType returns the MIME type of uploaded data from its content,
+// ignoring what the client claimed. SVGs are recognized by their root
+// element.
+func sniffImageType(data []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if (mediaType == "text/xml" || mediaType == "text/plain") && looksLikeSVG(data) {
+		return svgMimeType
+	}
+	return mediaType
+}
+
+// imageExtensions are the file extensions given to converted images.
+var imageExtensions = map[string]string{
+	"png":  ".png",
+	"jpeg": ".jpg",
+}
+
+// convertImage re-encodes a PNG, JPEG or single-frame GIF image as format
+// ("png" or "jpeg"). It returns ok=false for images already in that format,
+// animated GIFs, data it can't decode, images over maxImagePixels and
+// unsupported target formats, which are all stored as uploaded. Transparent areas become white in JPEG.
+func convertImage(data []byte, format string) (converted []byte, ok bool) {
+	if _, supported := imageExtensions[format]; !supported {
+		return nil, false
+	}
+	cfg, source, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || source == format || tooManyPixels(cfg) {
+		return nil, false
+	}
+	if source == "gif" {
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil || len(anim.Image) > 1 {
+			return nil, false
+		}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		flat := image.NewRGBA(src.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), src, src.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, src)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// withExtension replaces the extension of filename with that of format.
+func withExtension(filename, format string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + imageExtensions[format]
+}
+
+// boxResize scales src so its longer side is maxDim, averaging the source
+// pixels covered by each destination pixel.
+func boxResize(src image.Image, maxDim int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := maxDim, maxDim
+	if w >= h {
+		dh = max(1, h*maxDim/w)
+	} else {
+		dw = max(1, w*maxDim/h)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0 := dy * h / dh
+		y1 := max(y0+1, (dy+1)*h/dh)
+		for dx := 0; dx < dw; dx++ {
+			x0 := dx * w / dw
+			x1 := max(x0+1, (dx+1)*w/dw)
+
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				i := rgba.PixOffset(x0, y)
+				for x := x0; x < x1; x++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					bl += uint64(rgba.Pix[i+2])
+					a += uint64(rgba.Pix[i+3])
+					i += 4
+				}
+				n += uint64(x1 - x0)
+			}
+
+			o := dst.PixOffset(dx, dy)
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(bl / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+var (
+	imageRefOnce    sync.Once
+	imageRefPattern *regexp.Regexp
+)
+
+// imageRefs returns the IDs of uploaded images that content links to, as
+// /api/images/<id> or under --image-base-url.
+func imageRefs(content string) map[string]bool {
+	imageRefOnce.Do(func() {
+		prefixes := regexp.QuoteMeta("/api/images/")
+		if *imageBaseURL != "" {
+			prefixes += "|" + regexp.QuoteMeta(strings.TrimRight(*imageBaseURL, "/")+"/")
+		}
+		imageRefPattern = regexp.MustCompile(`(?:` + prefixes + `)([0-9a-f]+)`)
+	})
+
+	refs := make(map[string]bool)
+	for _, m := range imageRefPattern.FindAllStringSubmatch(content, -1) {
+		refs[m[1]] = true
+	}
+	return refs
+}
+
+// checkImageLimit fails when next links to more images than
+// --max-images-per-tab allows. Content already over the limit may still
+// be edited as long as it gains no images, so it can be trimmed down.
+func checkImageLimit(prev, next string) error {
+	if *maxTabImages <= 0 {
+		return nil
+	}
+	n := len(imageRefs(next))
+	if n <= *maxTabImages || n <= len(imageRefs(prev)) {
+		return nil
+	}
+	return fmt.Errorf("tab would contain %d images, over the %d image limit", n, *maxTabImages)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ImageStore persists uploaded images. Storage keeps the bytes as BLOBs in
+// SQLite; S3ImageStore keeps only the metadata row there and the bytes in an
+// S3-compatible bucket.
+type ImageStore interface {
+	SaveImage(img *ImageRecord) error
+	OpenImage(imageID string) (*ImageRecord, io.ReadCloser, error)
+	DeleteImage(imageID string) error
+}
+
+// errImageIDTaken is returned by SaveImage when the image ID is already in
+// use, so the caller can retry with another ID.
+var errImageIDTaken = errors.New("image ID already in use")
+
+// maxImageIDAttempts bounds how many fresh IDs an upload tries before
+// giving up.
+const maxImageIDAttempts = 5
+
+func newImageStore(storage *Storage) (ImageStore, error) {
+	switch *imageStore {
+	case "", "sqlite":
+		return storage, nil
+	case "s3":
+		secret := os.Getenv("BOARDCAST_S3_SECRET_KEY")
+		if secret == "" && *s3SecretFile != "" {
+			data, err := os.ReadFile(*s3SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("read S3 secret key file: %w", err)
+			}
+			secret = strings.TrimSpace(string(data))
+		}
+		if *s3Endpoint == "" || *s3Bucket == "" || *s3AccessKey == "" || secret == "" {
+			return nil, fmt.Errorf("s3 image store requires --s3-endpoint, --s3-bucket, --s3-access-key and a secret key")
+		}
+		return &S3ImageStore{
+			meta:      storage,
+			endpoint:  strings.TrimRight(*s3Endpoint, "/"),
+			bucket:    *s3Bucket,
+			region:    *s3Region,
+			accessKey: *s3AccessKey,
+			secretKey: secret,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown image store %q", *imageStore)
+	}
+}
+
+// S3ImageStore stores image bytes in an S3-compatible bucket using
+// path-style requests signed with AWS Signature Version 4.
+type S3ImageStore struct {
+	meta      *Storage
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *S3ImageStore) SaveImage(img *ImageRecord) error {
+	// Check before the PUT: a taken ID would overwrite the existing object.
+	if exists, err := s.meta.ImageExists(img.ID); err != nil {
+		return err
+	} else if exists {
+		return errImageIDTaken
+	}
+
+	resp, err := s.do("PUT", img.ID, img.Data, img.MimeType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	meta := *img
+	meta.Hash = sha256Hex(img.Data)
+	meta.Data = []byte{}
+	return s.meta.SaveImage(&meta)
+}
+
+func (s *S3ImageStore) OpenImage(imageID string) (*ImageRecord, io.ReadCloser, error) {
+	img, err := s.meta.GetImageMeta(imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := s.do("GET", imageID, nil, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, resp.Body, nil
+}
+
+func (s *S3ImageStore) DeleteImage(imageID string) error {
+	resp, err := s.do("DELETE", imageID, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.meta.DeleteImage(imageID)
+}
+
+func (s *S3ImageStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	u := s.endpoint + "/" + url.PathEscape(s.bucket) + "/" + url.PathEscape(key)
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *S3ImageStore) sign(req *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// maxIntegrityProblems caps how many problems integrity_check reports.
+const maxIntegrityProblems = 20
+
+// corruptionError is returned by NewStorage when the database file fails
+// SQLite's integrity check or isn't a database at all.
+type corruptionError struct {
+	path     string
+	problems []string
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("database %s is corrupted: %s", e.path, strings.Join(e.problems, "; "))
+}
+
+// checkIntegrity runs PRAGMA integrity_check on db, the database at path,
+// and returns a *corruptionError listing what it found, if anything.
+func checkIntegrity(db *sql.DB, path string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA integrity_check(%d)", maxIntegrityProblems))
+	if err != nil {
+		return integrityError(path, err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return integrityError(path, err)
+	}
+	if len(problems) > 0 {
+		return &corruptionError{path: path, problems: problems}
+	}
+	return nil
+}
+
+// integrityError turns an error from running the integrity check into a
+// *corruptionError when SQLite reports the file as damaged, rather than
+// busy or unreadable.
+func integrityError(path string, err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+			return &corruptionError{path: path, problems: []string{err.Error()}}
+		}
+	}
+	return fmt.Errorf("check database integrity: %w", err)
+}
+
+// RecoverStorage moves the corrupt database in dataDir aside, with its
+// write-ahead log, and copies every row that can still be read into a new
+// database in its place. Rows are read table by table in rowid order; when
+// a table can't be read to the end, the rows before the damage are kept.
+// Rows holding garbage text are skipped. Each step is logged, and the
+// moved file is left for inspection.
+func RecoverStorage(dataDir string, pragmas ...string) (*Storage, error) {
+	path := dataDir + "/boardcast.db"
+	aside := fmt.Sprintf("%s.corrupt-%s", path, time.Now().Format("20060102-150405"))
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(path+suffix, aside+suffix); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("move corrupt database aside: %w", err)
+		}
+	}
+	log.Printf("Recovery: moved corrupt database to %s", aside)
+
+	db, err := sql.Open("sqlite", "file:"+aside+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	old := &Storage{db: db}
+	defer old.Close()
+
+	storage, err := NewStorage(dataDir, pragmas...)
+	if err != nil {
+		return nil, fmt.Errorf("create new database: %w", err)
+	}
+	tables, err := storage.queryStrings("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_version' ORDER BY name")
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	total, lost, damaged := 0, 0, 0
+	for _, table := range tables {
+		copied, skipped, err := salvageTable(old, storage, table)
+		total += copied
+		lost += skipped
+		if err != nil {
+			damaged++
+			log.Printf("Recovery: table %s: copied %d rows, skipped %d damaged rows, then: %v", table, copied, skipped, err)
+			continue
+		}
+		log.Printf("Recovery: table %s: copied %d rows, skipped %d damaged rows", table, copied, skipped)
+	}
+	log.Printf("Recovery: copied %d rows into a new database and skipped %d damaged rows; %d of %d tables could not be read in full", total, lost, damaged, len(tables))
+	return storage, nil
+}
+
+// salvageTable copies the rows of table that can be read from src into
+// dst, using the columns both databases have, and returns how many it
+// copied and skipped. Rows with text that isn't valid UTF-8 are skipped:
+// they were read from damaged pages. The rows copied before an error are
+// kept.
+func salvageTable(src, dst *Storage, table string) (copied, skipped int, err error) {
+	columns, err := dst.queryStrings("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The corrupt database may predate some migrations. If its schema
+	// can't be read, try the new table's columns.
+	if have, err := src.queryStrings("SELECT name FROM pragma_table_info(?)", table); err == nil {
+		columns = slices.DeleteFunc(columns, func(c string) bool { return !slices.Contains(have, c) })
+	}
+	if len(columns) == 0 {
+		return 0, 0, errors.New("no columns in common")
+	}
+
+	// The unary + makes the driver return values as stored, rather than
+	// converting DATETIME columns to time.Time and back.
+	list := `"` + strings.Join(columns, `", "`) + `"`
+	values := `+"` + strings.Join(columns, `", +"`) + `"`
+	rows, err := src.db.Query(fmt.Sprintf(`SELECT %s FROM "%s" ORDER BY rowid`, values, table))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	tx, err := dst.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(fmt.Sprintf(`INSERT OR IGNORE INTO "%s" (%s) VALUES (?%s)`, table, list, strings.Repeat(", ?", len(columns)-1)))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer insert.Close()
+
+	row := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range row {
+		ptrs[i] = &row[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			break
+		}
+		if !validText(row) {
+			skipped++
+			continue
+		}
+		if _, err = insert.Exec(row...); err != nil {
+			break
+		}
+		copied++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if commitErr := tx.Commit(); commitErr != nil {
+		return 0, skipped, commitErr
+	}
+	return copied, skipped, err
+}
+
+// validText reports whether every string in row is valid UTF-8.
+func validText(row []interface{}) bool {
+	for _, v := range row {
+		if s, ok := v.(string); ok && !utf8.ValidString(s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewStorageRejectsCorruptDatabase(t *testing.T) {
+	dir := t.TempDir()
+	garbage := make([]byte, 8192)
+	for i := range garbage {
+		garbage[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(dir+"/boardcast.db", garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStorage(dir)
+	if err == nil {
+		s.Close()
+		t.Fatal("NewStorage opened a file that isn't a database")
+	}
+	var corrupt *corruptionError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("NewStorage error = %v, want a corruptionError", err)
+	}
+}
+
+func TestRecoverStorageCopiesRows(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.SaveTab(&Tab{ID: id, Name: id, Content: "content of " + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.historyDiffs = true
+	versions := historyVersions(5)
+	saveVersions(t, s, "a", versions)
+	s.Close()
+
+	recovered, err := RecoverStorage(dir)
+	if err != nil {
+		t.Fatalf("RecoverStorage: %v", err)
+	}
+	defer recovered.Close()
+
+	tabs, err := recovered.LoadTabs()
+	if err != nil {
+		t.Fatalf("LoadTabs: %v", err)
+	}
+	if len(tabs) != 3 {
+		t.Errorf("recovered %d tabs, want 3", len(tabs))
+	}
+	checkHistory(t, recovered, "a", versions)
+
+	aside, _ := filepath.Glob(dir + "/boardcast.db.corrupt-*")
+	if len(aside) != 1 {
+		t.Errorf("moved-aside files: %v, want one", aside)
+	}
+}
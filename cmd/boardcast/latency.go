@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent samples a latencyWindow keeps.
+const latencySamples = 1000
+
+// latencyWindow keeps the most recent latency samples for /api/stats.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	total   uint64
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, d)
+	} else {
+		w.samples[w.next] = d
+		w.next = (w.next + 1) % latencySamples
+	}
+	w.total++
+}
+
+// latencySummary describes a latencyWindow in milliseconds. Total counts
+// every sample ever added; the statistics cover the recent ones.
+type latencySummary struct {
+	Total uint64  `json:"total"`
+	AvgMs float64 `json:"avgMs"`
+	P50Ms float64 `json:"p50Ms"`
+	P95Ms float64 `json:"p95Ms"`
+	MaxMs float64 `json:"maxMs"`
+}
+
+func (w *latencyWindow) summary() latencySummary {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	total := w.total
+	w.mu.Unlock()
+
+	s := latencySummary{Total: total}
+	if len(sorted) == 0 {
+		return s
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	s.AvgMs = ms(sum / time.Duration(len(sorted)))
+	s.P50Ms = ms(sorted[len(sorted)/2])
+	s.P95Ms = ms(sorted[len(sorted)*95/100])
+	s.MaxMs = ms(sorted[len(sorted)-1])
+	return s
+}
@@ -1,56 +1,473 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	mrand "math/rand"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 )
 
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2024-01-01T00:00:00Z"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 var (
 	port         = flag.String("port", "8080", "Server port")
 	password     = flag.String("password", "", "Authentication password (deprecated, use env or file)")
 	passwordFile = flag.String("password-file", "", "Path to password file")
 	dataDir      = flag.String("data-dir", "./data", "Data directory for database and uploads")
+	storageMode  = flag.String("storage", "sqlite", "Where data is kept: sqlite (a database in --data-dir) or memory (lost on exit, for demos and tests)")
+	broadcastBuf = flag.Int("broadcast-buffer", 256, "Hub broadcast channel buffer size")
+	sendBuf      = flag.Int("send-buffer", 256, "Messages queued per client before a client that can't keep up is disconnected")
+	cookieSecure = flag.Bool("cookie-secure", false, "Mark the session cookie Secure (requires HTTPS)")
+	cookieSite   = flag.String("cookie-samesite", "lax", "SameSite mode for the session cookie: lax, strict or none")
+	tokenInBody  = flag.Bool("auth-token-response", false, "Also return the session token in the login response for Authorization: Bearer clients")
+	kiosk        = flag.Bool("kiosk", false, "Kiosk mode: WebSocket clients only receive updates; edits must come through /api/ingest")
+	brandingDir  = flag.String("branding-dir", "", "Directory of branding assets (logo, favicon) served at /branding/")
+	productName  = flag.String("product-name", "BoardCast", "Product name shown in the web UI and page title")
+	logoURL      = flag.String("logo-url", "", "Logo shown in the web UI, e.g. /branding/logo.svg (empty shows none)")
+	faviconURL   = flag.String("favicon-url", "", "Favicon for the web UI, e.g. /branding/favicon.png (empty keeps the default)")
+	imageBaseURL = flag.String("image-base-url", "", "Base URL for returned image links (e.g. a CDN); defaults to /api/images")
+	uploadLimit  = flag.Int64("upload-max-size", 10<<20, "Maximum image upload size in bytes")
+	maxBody      = flag.Int64("max-body-size", 32<<20, "Largest request body in bytes accepted by the JSON API; bigger ones get 413 (image uploads use --upload-max-size; 0 disables)")
+	uploadTTL    = flag.Duration("upload-resume-ttl", 30*time.Minute, "How long a chunked upload may go without a chunk before it is dropped")
+	uploadMemory = flag.Int64("upload-memory", 2<<20, "Upload bytes buffered in memory before spilling to temporary files")
+	imageMaxAge  = flag.Duration("image-cache-max-age", 365*24*time.Hour, "Cache-Control max-age for served images, which never change once uploaded (0 omits the header)")
+	maxTabImages = flag.Int("max-images-per-tab", 0, "Reject edits that would make a tab link to more than this many uploaded images (0 disables)")
+	imageTypes   = flag.String("allowed-image-types", "image/png,image/jpeg,image/gif,image/webp", "Comma-separated MIME types accepted for image uploads, checked against the file content; add image/svg+xml to accept SVGs, which are sanitized")
+	maxImageDim  = flag.Int("max-image-dimension", 2000, "Downscale uploaded PNG/JPEG images wider or taller than this many pixels (0 disables)")
+	imageFormat  = flag.String("image-format", "", "Re-encode uploaded PNG, JPEG and still GIF images to png or jpeg (empty keeps the uploaded format)")
+	imageStore   = flag.String("image-store", "sqlite", "Image storage backend: sqlite or s3")
+	s3Endpoint   = flag.String("s3-endpoint", "", "S3-compatible endpoint URL for the s3 image store")
+	s3Bucket     = flag.String("s3-bucket", "", "Bucket for the s3 image store")
+	s3Region     = flag.String("s3-region", "us-east-1", "Region for the s3 image store")
+	s3AccessKey  = flag.String("s3-access-key", "", "Access key for the s3 image store")
+	s3SecretFile = flag.String("s3-secret-key-file", "", "Path to the secret key file for the s3 image store (or BOARDCAST_S3_SECRET_KEY env)")
+	maxSnapshots = flag.Int("max-snapshots", 0, "Maximum number of stored snapshots (0 disables the limit)")
+	snapshotFull = flag.String("snapshot-limit-action", "reject", "What creating a snapshot beyond --max-snapshots does: reject (409) or prune (delete the oldest)")
+	snapshotMax  = flag.Int64("snapshot-max-size", 64<<20, "Maximum size in bytes of a snapshot's serialized tabs (0 disables the limit)")
+	sqliteCache  = flag.Int("sqlite-cache-size", 0, "SQLite PRAGMA cache_size: pages if positive, KiB if negative (0 keeps the default)")
+	sqliteSync   = flag.String("sqlite-synchronous", "", "SQLite PRAGMA synchronous: OFF, NORMAL, FULL or EXTRA (empty keeps the default)")
+	sqliteMmap   = flag.Int64("sqlite-mmap-size", 0, "SQLite PRAGMA mmap_size in bytes (0 disables memory mapping)")
+	sqliteWAL    = flag.Bool("sqlite-wal", false, "Use SQLite write-ahead logging (PRAGMA journal_mode=WAL)")
+	recoverDB    = flag.Bool("recover-db", false, "If the database fails its startup integrity check, move it aside and copy the rows that can be read into a new one instead of exiting")
+	saveInterval = flag.Duration("save-interval", 500*time.Millisecond, "Coalesce tab content writes, saving each edited tab at most this often (0 saves every edit)")
+	coalesce     = flag.Duration("coalesce-updates", 0, "Relay updates to the same tab at most once per this interval, sending only the latest content (0 relays every update; 50ms caps each tab at 20/sec)")
+	historyLimit = flag.Int("history-max-limit", 100, "Most history entries GET /api/history returns, whatever limit is requested")
+	historyDiffs = flag.Bool("history-diffs", false, "Store history entries as line diffs against the previous entry, with a full copy every 20 entries, to save space")
+	historyDelay = flag.Duration("history-debounce", 30*time.Second, "Save a history entry after a tab has been idle this long following edits (0 disables)")
+	apiKeyFlag   = flag.String("api-key", "", "Static key for POST /api/ingest (prefer BOARDCAST_API_KEY env or --api-key-file)")
+	apiKeyFile   = flag.String("api-key-file", "", "Path to the API key file for POST /api/ingest")
+	encScope     = flag.String("encryption-scope", "all", "What the encryption key protects: all (content, history, snapshots, templates, images) or tabs (only tabs marked with set-encrypted)")
+	encKeyFile   = flag.String("encryption-key-file", "", "Path to a 32-byte hex or base64 key for AES-GCM encryption of content and images at rest (or BOARDCAST_ENCRYPTION_KEY env)")
+	adminKeyFile = flag.String("admin-token-file", "", "Path to the operator token for admin endpoints (or BOARDCAST_ADMIN_TOKEN env)")
+	webhookURLs  = flag.String("webhook-url", "", "Comma-separated URLs notified when tabs change")
+	webhookKey   = flag.String("webhook-secret-file", "", "Path to the HMAC secret for webhook signatures (or BOARDCAST_WEBHOOK_SECRET env)")
+	expiryAction = flag.String("expiry-action", "clear", "What happens to a tab when its expiry passes: clear or delete")
+	invalidUTF8  = flag.String("invalid-utf8", "reject", "Handling of client messages that are not valid UTF-8: reject with an error reply, or replace bad bytes with U+FFFD")
+	newTabText   = flag.String("new-tab-content", "", "Content new tabs start with, including the default tab (templates override it)")
+	seedDir      = flag.String("seed-dir", "", "Directory of files to create tabs from at startup, named after the files without their extension; existing tabs are left alone")
+	seedOver     = flag.Bool("seed-overwrite", false, "With --seed-dir, also replace the content of existing tabs named after a file, saving their previous content to history")
+	newTabFile   = flag.String("new-tab-content-file", "", "Path to a file with the content new tabs start with; takes precedence over --new-tab-content")
+	binaryLimit  = flag.Float64("binary-threshold", 0.1, "Reject tab content with NUL bytes or more than this fraction of control characters as likely binary (0 disables)")
+	lfEndings    = flag.Bool("normalize-line-endings", false, "Convert CRLF line endings in tab content to LF before it is saved and relayed, including appends, imports and snapshots")
+	trimTrailing = flag.Bool("trim-trailing-whitespace", false, "Strip trailing spaces and tabs from every line of tab content before it is saved and relayed")
+	redactRegex  = flag.String("redact-pattern", "", "Regular expression whose matches in tab content are replaced with [REDACTED] before it is saved and relayed")
+	maxNameLen   = flag.Int("max-name-length", 200, "Maximum length in characters of tab, template and snapshot names (0 disables)")
+	nameConflict = flag.String("tab-name-conflict", "reject", "Handling of create/rename to a name already in use (case-insensitive): reject or suffix")
+	maintReady   = flag.Bool("maintenance-unready", false, "Fail /readyz while maintenance mode is on, so load balancers route around read-only instances")
+	initMode     = flag.String("init-mode", "full", "Tab data sent in init: full, or metadata to leave out content, which clients then request per tab with get")
+	presenceTick = flag.Duration("presence-interval", 5*time.Second, "How often to check per-tab viewer counts and send clients a presence message when they changed (0 disables)")
+	maxSubs      = flag.Int("max-subscriptions", 100, "Most tabs one WebSocket client may be subscribed to at once (0 disables the limit)")
+	expiryWarn   = flag.Duration("session-expiry-warning", 5*time.Minute, "Send WebSocket clients a token-expiring message this long before their session expires (0 disables)")
+	reconnectMin = flag.Duration("reconnect-backoff", 0, "Suggested reconnect delay sent to clients closed on shutdown or overload; each gets a random delay between this and twice this (0 sends none)")
+	idleTimeout  = flag.Duration("idle-timeout", 0, "Disconnect WebSocket clients with no activity for this long (0 disables)")
+	idleActivity = flag.String("idle-activity", "client", "What counts as activity for --idle-timeout: client (messages from the client) or any (also updates sent to it)")
+	originPolicy = flag.String("origin-permissions", "", "Comma-separated origin=read|write entries limiting which browser origins may open WebSockets and whether they may edit; * matches other origins (empty allows all)")
+	corsMaxAge   = flag.Duration("cors-max-age", 0, "How long browsers may cache CORS preflight responses (0 sends no Access-Control-Max-Age)")
+	trustedProxy = flag.String("trusted-proxies", "", "Comma-separated CIDRs of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted for client IPs")
+	upstreamURL  = flag.String("upstream-url", "", "Follower mode: mirror the primary at this WebSocket URL (e.g. ws://primary:8080/api/ws) and serve it read-only")
+	upstreamPass = flag.String("upstream-password-file", "", "Path to the primary's password for follower mode (or BOARDCAST_UPSTREAM_PASSWORD env)")
+	connectRate  = flag.Int("ws-connect-rate", 10, "WebSocket connection attempts allowed per client IP per minute; more get 429 (0 disables)")
+	maxMessage   = flag.Int64("max-message-size", 16<<20, "Largest WebSocket message in bytes a client may send; bigger ones close the connection (0 disables)")
+	dropUpdates  = flag.Bool("broadcast-drop-updates", false, "Keep only the newest content update per tab instead of blocking when the broadcast channel is full")
+	shedLevel    = flag.Float64("shed-threshold", 0, "Reject new WebSocket/event stream connections, uploads and snapshots with 503 while the broadcast channel is at least this fraction full, e.g. 0.8 (0 disables)")
+	shedClients  = flag.Int("shed-max-clients", 0, "Also shed new work while this many clients are connected (0 disables)")
 	sessions     = make(map[string]time.Time)
 	sessionMu    sync.RWMutex
 	upgrader     = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			return true
+			_, allowed := originPermission(r)
+			return allowed
 		},
+		Subprotocols: []string{wsProtocol},
 	}
 )
 
 type Tab struct {
-	ID      string `json:"id"`
-	Name    string `json:"name"`
-	Content string `json:"content"`
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Content    string     `json:"content"`
+	Archived   bool       `json:"archived,omitempty"`
+	Language   string     `json:"language,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	RenderMode string     `json:"renderMode,omitempty"`
+	Pinned     bool       `json:"pinned,omitempty"`
+	Color      string     `json:"color,omitempty"`
+
+	// Encrypted tabs have their content, translations and history
+	// encrypted at rest even with --encryption-scope=tabs.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// Locales holds translations of Content keyed by language code, e.g.
+	// "de" or "pt-BR". Content stays the primary language. The map is
+	// replaced, never modified, so copies made by tabList stay valid.
+	Locales map[string]string `json:"locales,omitempty"`
+
+	// Chars and Words are computed from Content by countText whenever tabs
+	// are sent to clients; they are not stored.
+	Chars int `json:"chars"`
+	Words int `json:"words"`
+
+	// Version counts the updates to Content since the server started. It
+	// is sent in init and get replies, as the base for delta updates.
+	Version uint64 `json:"version,omitempty"`
+
+	// Updated is the time of the last change, used to order tab lists.
+	// Clients get it so they can tell whether a tab they cached is current.
+	Updated time.Time `json:"updated"`
+}
+
+// hasTag reports whether the tab carries tag, ignoring case.
+func (t *Tab) hasTag(tag string) bool {
+	for _, existing := range t.Tags {
+		if strings.EqualFold(existing, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// textCounts returns the number of Unicode characters and of
+// whitespace-separated words in content. Markdown is counted as raw text.
+func textCounts(content string) (chars, words int) {
+	return utf8.RuneCountInString(content), len(strings.Fields(content))
+}
+
+func (t *Tab) countText() {
+	t.Chars, t.Words = textCounts(t.Content)
+}
+
+// errBinaryContent rejects edits that look like a pasted binary file.
+var errBinaryContent = errors.New("content looks like binary data; upload files with POST /api/upload instead")
+
+// looksBinary reports whether content is likely binary rather than text: it
+// contains a NUL character, or more than --binary-threshold of its
+// characters are control characters other than whitespace or bytes that
+// were not valid UTF-8.
+func looksBinary(content string) bool {
+	if *binaryLimit <= 0 || content == "" {
+		return false
+	}
+	total, odd := 0, 0
+	for _, r := range content {
+		total++
+		switch {
+		case r == 0:
+			return true
+		case r == '\n' || r == '\r' || r == '\t' || r == '\f':
+		case r == utf8.RuneError || unicode.IsControl(r):
+			odd++
+		}
+	}
+	return float64(odd) > *binaryLimit*float64(total)
+}
+
+// localeCodes returns the sorted codes of the tab's translations.
+func (t *Tab) localeCodes() []string {
+	codes := make([]string, 0, len(t.Locales))
+	for code := range t.Locales {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// validLocale reports whether code looks like a BCP 47 language tag: a two
+// or three letter language followed by alphanumeric subtags, e.g. "en",
+// "pt-BR" or "zh-Hant".
+func validLocale(code string) bool {
+	parts := strings.Split(code, "-")
+	if len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return false
+	}
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 8 {
+			return false
+		}
+		for _, r := range part {
+			letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+			if !letter && (i == 0 || r < '0' || r > '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeTags trims tags and drops empty and duplicate entries.
+func normalizeTags(tags []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		key := strings.ToLower(tag)
+		if tag == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, tag)
+	}
+	return result
+}
+
+// cleanName trims surrounding whitespace from a tab, template or snapshot
+// name and rejects empty names and names over --max-name-length characters.
+func cleanName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("name must not be empty")
+	}
+	if n := utf8.RuneCountInString(name); *maxNameLen > 0 && n > *maxNameLen {
+		return "", fmt.Errorf("name is %d characters, over the %d character limit", n, *maxNameLen)
+	}
+	return name, nil
+}
+
+// renderModes are the ways a client may render a tab. An empty mode means
+// markdown.
+var renderModes = map[string]bool{
+	"markdown": true,
+	"plain":    true,
+	"code":     true,
+}
+
+// tabColors are the named colors a tab may be labeled with, besides hex
+// colors. The names are valid CSS colors so clients can use them directly.
+var tabColors = map[string]bool{
+	"red": true, "orange": true, "yellow": true, "green": true, "teal": true,
+	"blue": true, "purple": true, "pink": true, "gray": true,
+}
+
+// cleanColor lower-cases color and checks that it is a named tab color or
+// a #rgb or #rrggbb hex color.
+func cleanColor(color string) (string, error) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if tabColors[color] {
+		return color, nil
+	}
+	if hex, ok := strings.CutPrefix(color, "#"); ok && (len(hex) == 3 || len(hex) == 6) {
+		if _, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return color, nil
+		}
+	}
+	return "", fmt.Errorf("unknown color %q: use a #rgb or #rrggbb hex color or one of red, orange, yellow, green, teal, blue, purple, pink, gray", color)
+}
+
+// languages are the syntax highlighting modes a tab may be tagged with.
+// The names match the Monaco editor language IDs used by the frontend.
+var languages = map[string]bool{
+	"plaintext": true, "markdown": true, "javascript": true, "typescript": true,
+	"python": true, "go": true, "rust": true, "java": true, "kotlin": true,
+	"c": true, "cpp": true, "csharp": true, "php": true, "ruby": true,
+	"swift": true, "shell": true, "powershell": true, "sql": true, "json": true,
+	"yaml": true, "xml": true, "html": true, "css": true, "dockerfile": true,
+	"lua": true, "perl": true, "r": true, "scala": true, "ini": true,
 }
 
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan []byte
+	byID       map[string]*Client
+	clientsMu  sync.RWMutex
+	viewers    map[string]map[*Client]string // tab ID -> subscribed clients and their names, under clientsMu
+	broadcast  chan inbound
 	register   chan *Client
 	unregister chan *Client
 	tabs       map[string]*Tab
+	dirty      map[string]time.Time
+	unsaved    map[string]bool
+	held       map[string]contentUpdate // latest update per tab waiting out --coalesce-updates
+	lastSent   map[string]time.Time     // when an update for the tab was last relayed
+	versions   map[string]uint64        // tab ID -> content version, bumped by every update
+	release    chan string
+	resets     chan chan error
+	deletes    map[string]pendingDelete // delete-request tokens
+	claims     map[string]tabClaim      // tab ID -> client holding an edit claim
 	storage    *Storage
+	images     ImageStore
+	webhooks   *WebhookNotifier
 	mu         sync.RWMutex
+
+	// pending holds, per tab, the newest full-content update that found the
+	// broadcast channel full under --broadcast-drop-updates. run queues it
+	// once the channel drains.
+	pending      map[string]inbound
+	pendingMu    sync.Mutex
+	pendingReady chan struct{}
+
+	dropped     atomic.Uint64
+	lastSatWarn atomic.Int64
+	maintenance atomic.Bool // see setMaintenance
+
+	rtt      latencyWindow // round trips reported by clients in ping
+	hubDelay latencyWindow // time pings waited for the hub
+}
+
+// deleteTokenTTL is how long a token from delete-request stays valid for
+// delete-confirm.
+const deleteTokenTTL = 10 * time.Second
+
+// pendingDelete is a tab deletion requested by client and awaiting
+// confirmation.
+type pendingDelete struct {
+	tabID   string
+	client  *Client
+	expires time.Time
+}
+
+// tabClaim is a client's exclusive claim to edit a tab, under the name it
+// gave. Claims live until released or the client disconnects.
+type tabClaim struct {
+	client *Client
+	name   string
+}
+
+// claimedMessages are the message types refused from other clients while
+// a tab is claimed.
+var claimedMessages = map[string]bool{
+	"update":             true,
+	"append":             true,
+	"move":               true,
+	"set-locale-content": true,
+}
+
+// inbound is a message queued for the hub together with the client that
+// sent it, or nil for messages from the server itself (ingest, timers,
+// upstream).
+type inbound struct {
+	from    *Client
+	message []byte
+	queued  time.Time
 }
 
 type Client struct {
+	id   string
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+
+	remoteAddr string
+	connected  time.Time
+
+	// receiveOnly clients (kiosk displays) may only send the message types
+	// in kioskMessages; everything else is discarded in readPump.
+	receiveOnly bool
+
+	// subscribed holds the tab IDs the client has subscribed to, under
+	// hub.clientsMu.
+	subscribed map[string]bool
+
+	// readOnly clients connected from an origin with read permission
+	// (--origin-permissions). The hub rejects their edits with an error.
+	readOnly bool
+
+	// lastActive is the UnixNano time of the client's last activity as
+	// defined by --idle-activity. Pongs don't count.
+	lastActive atomic.Int64
+
+	// session is the session ID or token the client authenticated with.
+	// The client is disconnected once it is no longer valid.
+	session string
+
+	// expiryWarned is set once the client has been sent token-expiring.
+	// Only disconnectExpired uses it.
+	expiryWarned bool
+
+	// delta clients said hello with the delta capability and get content
+	// updates as patches; see relayUpdate. Only the hub goroutine uses it.
+	delta bool
+
+	// metadataInit clients get init without tab content and request it per
+	// tab with get; see --init-mode.
+	metadataInit bool
+
+	// closeMsg is the close frame payload writePump sends when the hub
+	// drops the client; see closeClient.
+	closeMsg []byte
+}
+
+// Close codes the server sends, each with a short reason, so clients can
+// tell re-authenticating from reconnecting from giving up. Idle timeouts use
+// 1000, oversized messages 1009 and server shutdown 1001.
+const (
+	closeSessionExpired = 4001 // log in again before reconnecting
+	closeKicked         = 4002 // disconnected by an operator
+	closeTooSlow        = 4003 // fell too far behind; reconnecting is fine
+)
+
+// retryReason appends a suggested reconnect delay to a close reason, as
+// "; retry=<ms>", when --reconnect-backoff is set. The delay is spread
+// between one and two times the backoff so clients don't all come back at
+// once.
+func retryReason(reason string) string {
+	if *reconnectMin <= 0 {
+		return reason
+	}
+	delay := *reconnectMin + time.Duration(mrand.Int63n(int64(*reconnectMin)))
+	return fmt.Sprintf("%s; retry=%d", reason, delay.Milliseconds())
+}
+
+// kioskMessages are the only message types accepted from receive-only
+// clients. None of them mutate board state.
+var kioskMessages = map[string]bool{
+	"subscribe":   true,
+	"unsubscribe": true,
+	"ping":        true,
+	"get":         true,
+	"hello":       true,
 }
 
 type Message struct {
@@ -59,15 +476,61 @@ type Message struct {
 	Content      string              `json:"content,omitempty"`
 	Name         string              `json:"name,omitempty"`
 	Description  string              `json:"description,omitempty"`
+	Template     string              `json:"template,omitempty"`
+	Language     string              `json:"language,omitempty"`
+	Tags         []string            `json:"tags,omitempty"`
+	ExpiresAt    *time.Time          `json:"expiresAt,omitempty"`
+	Patches      []TextPatch         `json:"patches,omitempty"`
+	RenderMode   string              `json:"renderMode,omitempty"`
 	Token        string              `json:"token,omitempty"`
 	Tabs         []*Tab              `json:"tabs,omitempty"`
 	History      []HistoryRecord     `json:"history,omitempty"`
 	Snapshots    []SnapshotRecord    `json:"snapshots,omitempty"`
 	SnapshotID   int                 `json:"snapshotId,omitempty"`
 	HistoryID    int                 `json:"historyId,omitempty"`
+	Label        string              `json:"label,omitempty"`
 	ImageID      string              `json:"imageId,omitempty"`
 	ImageURL     string              `json:"imageUrl,omitempty"`
 	Limit        int                 `json:"limit,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	SourceTabID  string              `json:"sourceTabId,omitempty"`
+	TargetTabID  string              `json:"targetTabId,omitempty"`
+	Offset       int                 `json:"offset,omitempty"`
+	Length       int                 `json:"length,omitempty"`
+	Chars        int                 `json:"chars,omitempty"`
+	Words        int                 `json:"words,omitempty"`
+	AckID        string              `json:"ackId,omitempty"`
+	Color        string              `json:"color,omitempty"`
+	Locale       string              `json:"locale,omitempty"`
+	Locales      []string            `json:"locales,omitempty"`
+	Count        int                 `json:"count,omitempty"`
+	Names        []string            `json:"names,omitempty"`
+	Encrypted    bool                `json:"encrypted,omitempty"`
+	Timestamp    int64               `json:"timestamp,omitempty"`
+	Latency      float64             `json:"latency,omitempty"`
+	Presence     map[string]int      `json:"presence,omitempty"`
+	Metadata     bool                `json:"metadata,omitempty"`
+	Capabilities []string            `json:"capabilities,omitempty"`
+	Version      uint64              `json:"version,omitempty"`
+	BaseVersion  uint64              `json:"baseVersion,omitempty"`
+	Maintenance  bool                `json:"maintenance,omitempty"`
+}
+
+// newTabContent is what tabs created without a template start with; see
+// getNewTabContent.
+var newTabContent string
+
+// getNewTabContent returns the content of --new-tab-content-file, or else
+// --new-tab-content. The file is used as is, trailing newline included.
+func getNewTabContent() string {
+	if *newTabFile != "" {
+		data, err := os.ReadFile(*newTabFile)
+		if err != nil {
+			log.Fatalf("Failed to read new tab content file: %v", err)
+		}
+		return string(data)
+	}
+	return *newTabText
 }
 
 func getPassword() string {
@@ -93,6 +556,275 @@ func getPassword() string {
 	return "boardcast"
 }
 
+// getAPIKey returns the ingest API key, or "" when ingest is disabled. It
+// follows the same precedence as getPassword.
+func getAPIKey() string {
+	if env := os.Getenv("BOARDCAST_API_KEY"); env != "" {
+		return env
+	}
+
+	if *apiKeyFile != "" {
+		data, err := os.ReadFile(*apiKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read API key file: %v", err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	return *apiKeyFlag
+}
+
+// buildInfo returns the version details, filling in the VCS revision and
+// time recorded by the Go toolchain when they were not set via -ldflags.
+func buildInfo() map[string]string {
+	info := map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" && info["commit"] == "unknown" {
+				info["commit"] = setting.Value
+			}
+			if setting.Key == "vcs.time" && info["buildDate"] == "unknown" {
+				info["buildDate"] = setting.Value
+			}
+		}
+		info["goVersion"] = bi.GoVersion
+	}
+	return info
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(buildInfo())
+}
+
+// handleStats reports connection counts and latency: the round trips
+// clients measured with ping, and how long pings waited in the hub's
+// queue. A slow hub shows in both, a slow network only in the first.
+func handleStats(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hub.clientsMu.RLock()
+		clients := len(hub.clients)
+		hub.clientsMu.RUnlock()
+		hub.mu.RLock()
+		tabs := len(hub.tabs)
+		hub.mu.RUnlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"clients":   clients,
+			"tabs":      tabs,
+			"queued":    len(hub.broadcast),
+			"roundTrip": hub.rtt.summary(),
+			"hubDelay":  hub.hubDelay.summary(),
+		})
+	}
+}
+
+// handleBranding serves the product name and asset URLs the web UI shows,
+// so deployments can be rebranded without rebuilding it. It is public, as
+// the login page uses it.
+func handleBranding(w http.ResponseWriter, r *http.Request) {
+	branding := map[string]string{"name": *productName}
+	if *logoURL != "" {
+		branding["logoUrl"] = *logoURL
+	}
+	if *faviconURL != "" {
+		branding["faviconUrl"] = *faviconURL
+	}
+	json.NewEncoder(w).Encode(branding)
+}
+
+// handleHealthz reports that the process is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the server can serve edits, failing while
+// storage writes are failing.
+func handleReadyz(hub *Hub, storage *Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := storage.WriteError(); err != nil {
+			http.Error(w, "storage degraded: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if *maintReady && hub.maintenance.Load() {
+			http.Error(w, "read-only for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// getAdminToken returns the operator token, or "" when operator endpoints
+// are disabled.
+func getAdminToken() string {
+	if env := os.Getenv("BOARDCAST_ADMIN_TOKEN"); env != "" {
+		return env
+	}
+
+	if *adminKeyFile != "" {
+		data, err := os.ReadFile(*adminKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read admin token file: %v", err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	return ""
+}
+
+func webhookSecret() []byte {
+	if env := os.Getenv("BOARDCAST_WEBHOOK_SECRET"); env != "" {
+		return []byte(env)
+	}
+
+	if *webhookKey != "" {
+		data, err := os.ReadFile(*webhookKey)
+		if err != nil {
+			log.Fatalf("Failed to read webhook secret file: %v", err)
+		}
+		return []byte(strings.TrimSpace(string(data)))
+	}
+
+	log.Println("Warning: No webhook secret set. Webhook requests will not be signed")
+	return nil
+}
+
+// sqlitePragmas builds the per-connection SQLite pragmas from the flags.
+func sqlitePragmas() []string {
+	var pragmas []string
+	if *sqliteWAL {
+		pragmas = append(pragmas, "journal_mode(WAL)")
+	}
+	if *sqliteSync != "" {
+		mode := strings.ToUpper(*sqliteSync)
+		switch mode {
+		case "OFF", "NORMAL", "FULL", "EXTRA":
+			pragmas = append(pragmas, fmt.Sprintf("synchronous(%s)", mode))
+		default:
+			log.Fatalf("Invalid --sqlite-synchronous value %q", *sqliteSync)
+		}
+	}
+	if *sqliteCache != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("cache_size(%d)", *sqliteCache))
+	}
+	if *sqliteMmap > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("mmap_size(%d)", *sqliteMmap))
+	}
+	return pragmas
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+type requestIDKey struct{}
+
+func generateRequestID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// requestIDMiddleware tags each request with a short random ID, echoed in
+// the X-Request-ID header and included in log lines for the request.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := generateRequestID()
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// bodyLimitMiddleware caps request bodies at --max-body-size, answering 413
+// when one is bigger. Bodies are still streamed to the handler; if it fails
+// after reading past the limit, its error response is replaced with the
+// 413, so every endpoint fails the same way however it decodes. Uploads
+// have their own limit, --upload-max-size.
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *maxBody <= 0 || r.Body == nil || r.Body == http.NoBody || isUploadPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > *maxBody {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, *maxBody)}
+		r.Body = body
+		next.ServeHTTP(&limitedBodyWriter{ResponseWriter: w, body: body}, r)
+	})
+}
+
+// isUploadPath reports whether path takes image data, limited by
+// --upload-max-size rather than --max-body-size: a plain upload or a
+// chunk of a resumable one.
+func isUploadPath(path string) bool {
+	return path == "/api/upload" || (strings.HasPrefix(path, "/api/upload/") && strings.HasSuffix(path, "/chunk"))
+}
+
+// limitedBody notes when a request body read by bodyLimitMiddleware goes
+// over the limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// limitedBodyWriter replaces a handler's error response with 413 when the
+// body was too large, whatever error the handler made of that.
+type limitedBodyWriter struct {
+	http.ResponseWriter
+	body     *limitedBody
+	replaced bool
+}
+
+func (w *limitedBodyWriter) WriteHeader(code int) {
+	if code >= 400 && w.body.exceeded {
+		w.replaced = true
+		http.Error(w.ResponseWriter, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitedBodyWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *limitedBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
 func generateSessionID() string {
 	b := make([]byte, 32)
 	rand.Read(b)
@@ -126,6 +858,14 @@ func validateSession(sessionID string) bool {
 	return true
 }
 
+// sessionExpiry returns when a valid session expires.
+func sessionExpiry(sessionID string) (time.Time, bool) {
+	sessionMu.RLock()
+	defer sessionMu.RUnlock()
+	expiry, exists := sessions[sessionID]
+	return expiry, exists
+}
+
 func deleteSession(sessionID string) {
 	sessionMu.Lock()
 	delete(sessions, sessionID)
@@ -148,14 +888,29 @@ func cleanupSessions() {
 	}()
 }
 
-func newHub(storage *Storage) *Hub {
+func newHub(storage *Storage, images ImageStore) *Hub {
 	hub := &Hub{
-		broadcast:  make(chan []byte, 256),
+		broadcast:  make(chan inbound, *broadcastBuf),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		byID:       make(map[string]*Client),
+		viewers:    make(map[string]map[*Client]string),
 		tabs:       make(map[string]*Tab),
+		dirty:      make(map[string]time.Time),
+		unsaved:    make(map[string]bool),
+		held:       make(map[string]contentUpdate),
+		lastSent:   make(map[string]time.Time),
+		versions:   make(map[string]uint64),
+		release:    make(chan string),
+		resets:     make(chan chan error),
+		deletes:    make(map[string]pendingDelete),
+		claims:     make(map[string]tabClaim),
 		storage:    storage,
+		images:     images,
+
+		pending:      make(map[string]inbound),
+		pendingReady: make(chan struct{}, 1),
 	}
 
 	// Load tabs from storage
@@ -171,305 +926,2627 @@ func newHub(storage *Storage) *Hub {
 
 	// Create default tab if none exist
 	if len(hub.tabs) == 0 {
-		defaultTab := &Tab{
-			ID:      "default",
-			Name:    "Main",
-			Content: "",
-		}
-		hub.tabs[defaultTab.ID] = defaultTab
-		storage.SaveTab(defaultTab)
+		hub.addDefaultTab()
 	}
 
 	return hub
 }
 
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-			h.mu.RLock()
-			tabs := make([]*Tab, 0, len(h.tabs))
-			for _, tab := range h.tabs {
-				tabs = append(tabs, tab)
+func (h *Hub) addDefaultTab() {
+	defaultTab := &Tab{
+		ID:      "default",
+		Name:    "Main",
+		Content: newTabContent,
+	}
+	h.tabs[defaultTab.ID] = defaultTab
+	h.storage.SaveTab(defaultTab)
+}
+
+// reset wipes all tabs, history, snapshots and images, leaving only a fresh
+// default tab, and sends every client a new init. It runs on the hub
+// goroutine; see handleReset.
+func (h *Hub) reset() error {
+	h.mu.Lock()
+	ids, err := h.storage.Reset()
+	if err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	h.tabs = make(map[string]*Tab)
+	h.dirty = make(map[string]time.Time)
+	h.unsaved = make(map[string]bool)
+	h.held = make(map[string]contentUpdate)
+	h.versions = make(map[string]uint64)
+	h.deletes = make(map[string]pendingDelete)
+	h.claims = make(map[string]tabClaim)
+	h.addDefaultTab()
+	h.clientsMu.Lock()
+	for tabID := range h.viewers {
+		h.dropViewer(tabID, nil)
+	}
+	h.clientsMu.Unlock()
+	h.mu.Unlock()
+
+	// Image rows are gone with the transaction; external stores still hold
+	// the bytes.
+	if h.images != ImageStore(h.storage) {
+		for _, id := range ids {
+			if err := h.images.DeleteImage(id); err != nil {
+				log.Printf("Failed to delete image %s: %v", id, err)
 			}
-			h.mu.RUnlock()
+		}
+	}
 
-			msg, _ := json.Marshal(Message{
-				Type: "init",
-				Tabs: tabs,
-			})
-			client.send <- msg
-			log.Printf("Client connected. Total clients: %d", len(h.clients))
+	msg, _ := json.Marshal(Message{Type: "init", Tabs: h.tabList()})
+	h.fanOut(msg, nil)
+	return nil
+}
 
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-				log.Printf("Client disconnected. Total clients: %d", len(h.clients))
-			}
+// enqueue hands a server-originated message to the hub.
+func (h *Hub) enqueue(message []byte) {
+	h.enqueueFrom(nil, message)
+}
 
-		case message := <-h.broadcast:
-			var msg Message
-			if err := json.Unmarshal(message, &msg); err == nil {
-				h.mu.Lock()
-				switch msg.Type {
-				case "update":
-					if tab, exists := h.tabs[msg.TabID]; exists {
-						tab.Content = msg.Content
-						h.storage.SaveTab(tab)
-					}
-				case "create":
-					newTab := &Tab{
-						ID:      msg.TabID,
-						Name:    msg.Name,
-						Content: "",
-					}
-					h.tabs[newTab.ID] = newTab
-					h.storage.SaveTab(newTab)
-				case "rename":
-					if tab, exists := h.tabs[msg.TabID]; exists {
-						tab.Name = msg.Name
-						h.storage.SaveTab(tab)
-					}
-				case "delete":
-					delete(h.tabs, msg.TabID)
-					h.storage.DeleteTab(msg.TabID)
-				}
-				h.mu.Unlock()
-			}
+// enqueueFrom hands a client message to the hub. It warns when the broadcast
+// channel is close to full and, if configured, parks content updates rather
+// than blocking the sender's read loop; see queuePending.
+func (h *Hub) enqueueFrom(from *Client, message []byte) {
+	if used, size := len(h.broadcast), cap(h.broadcast); size > 0 && used*5 >= size*4 {
+		now := time.Now().UnixNano()
+		last := h.lastSatWarn.Load()
+		if now-last >= int64(10*time.Second) && h.lastSatWarn.CompareAndSwap(last, now) {
+			log.Printf("Warning: broadcast channel saturated (%d/%d queued, %d dropped)", used, size, h.dropped.Load())
+		}
+	}
 
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
+	in := inbound{from: from, message: message, queued: time.Now()}
+	tabID, droppable := "", false
+	if *dropUpdates {
+		tabID, droppable = droppableTab(message)
+	}
+	if droppable {
+		// A parked update for the tab is older than this one and must
+		// not be relayed after it.
+		h.pendingMu.Lock()
+		if _, ok := h.pending[tabID]; ok {
+			delete(h.pending, tabID)
+			h.dropped.Add(1)
+		}
+		h.pendingMu.Unlock()
+	}
+	select {
+	case h.broadcast <- in:
+		return
+	default:
+	}
+
+	if droppable {
+		h.pendingMu.Lock()
+		if _, ok := h.pending[tabID]; ok {
+			h.dropped.Add(1)
+		}
+		h.pending[tabID] = in
+		h.pendingMu.Unlock()
+		select {
+		case h.pendingReady <- struct{}{}:
+		default:
 		}
+		return
 	}
+	h.broadcast <- in
 }
 
-func (c *Client) readPump() {
-	defer func() {
-		c.hub.unregister <- c
+// queuePending moves parked updates into the broadcast channel once it is
+// empty, so they are handled after every message queued before them. It
+// runs on the hub goroutine, the channel's only reader.
+func (h *Hub) queuePending() {
+	if len(h.broadcast) > 0 {
+		return
+	}
+	h.pendingMu.Lock()
+	defer h.pendingMu.Unlock()
+	for tabID, in := range h.pending {
+		select {
+		case h.broadcast <- in:
+			delete(h.pending, tabID)
+		default:
+			return
+		}
+	}
+}
+
+// reply sends msg to client alone. Replies to server-originated messages
+// and to clients that have since disconnected are dropped, as are replies
+// to clients whose send buffer is full.
+func (h *Hub) reply(client *Client, msg Message) {
+	if client == nil {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	if _, ok := h.clients[client]; ok {
+		select {
+		case client.send <- data:
+		default:
+		}
+	}
+}
+
+// messageType extracts the type field of a raw client message.
+func messageType(message []byte) string {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return ""
+	}
+	return msg.Type
+}
+
+// droppableTab reports whether a message may be superseded under load, and
+// for which tab. Only full-content updates qualify, since a newer one for
+// the same tab replaces them outright; partial updates and structural
+// changes are never dropped.
+func droppableTab(message []byte) (string, bool) {
+	var msg struct {
+		Type    string          `json:"type"`
+		TabID   string          `json:"tabId"`
+		Patches json.RawMessage `json:"patches"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return "", false
+	}
+	return msg.TabID, msg.Type == "update" && len(msg.Patches) == 0
+}
+
+// tabList returns copies of the active tabs, safe to use without holding h.mu.
+func (h *Hub) tabList() []*Tab {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	tabs := make([]*Tab, 0, len(h.tabs))
+	for _, tab := range h.tabs {
+		t := *tab
+		t.countText()
+		tabs = append(tabs, &t)
+	}
+	sortTabs(tabs)
+	return tabs
+}
+
+// sortTabs orders pinned tabs first, then most recently updated, matching
+// the order tabs are loaded from storage.
+func sortTabs(tabs []*Tab) {
+	sort.Slice(tabs, func(i, j int) bool {
+		a, b := tabs[i], tabs[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		if !a.Updated.Equal(b.Updated) {
+			return a.Updated.After(b.Updated)
+		}
+		return a.ID < b.ID
+	})
+}
+
+func (h *Hub) addClient(client *Client) {
+	h.clientsMu.Lock()
+	h.clients[client] = true
+	h.byID[client.id] = client
+	h.clientsMu.Unlock()
+}
+
+// clientCount returns how many clients are connected.
+func (h *Hub) clientCount() int {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	return len(h.clients)
+}
+
+// removeClient drops client from the hub and closes its send channel, which
+// makes writePump close the connection. It reports whether the client was
+// still registered.
+func (h *Hub) removeClient(client *Client) bool {
+	return h.closeClient(client, nil)
+}
+
+// closeClient is removeClient with a close frame payload for writePump to
+// send, e.g. from websocket.FormatCloseMessage.
+func (h *Hub) closeClient(client *Client, closeMsg []byte) bool {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	client.closeMsg = closeMsg
+	delete(h.clients, client)
+	delete(h.byID, client.id)
+	for tabID := range h.viewers {
+		h.dropViewer(tabID, client)
+	}
+	close(client.send)
+	return true
+}
+
+// subscribe records that client is viewing tabID, under an optional display
+// name. Clients may view at most --max-subscriptions tabs at once.
+func (h *Hub) subscribe(client *Client, tabID, name string) error {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	if _, ok := h.clients[client]; !ok {
+		return nil
+	}
+	if !client.subscribed[tabID] && *maxSubs > 0 && len(client.subscribed) >= *maxSubs {
+		return fmt.Errorf("subscription limit of %d tabs reached; unsubscribe from one first", *maxSubs)
+	}
+	if client.subscribed == nil {
+		client.subscribed = make(map[string]bool)
+	}
+	client.subscribed[tabID] = true
+	if h.viewers[tabID] == nil {
+		h.viewers[tabID] = make(map[*Client]string)
+	}
+	h.viewers[tabID][client] = name
+	return nil
+}
+
+func (h *Hub) unsubscribe(client *Client, tabID string) {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	h.dropViewer(tabID, client)
+}
+
+// dropViewer removes client from tabID's viewers, or every viewer for a nil
+// client. The caller must hold clientsMu.
+func (h *Hub) dropViewer(tabID string, client *Client) {
+	if client == nil {
+		for c := range h.viewers[tabID] {
+			delete(c.subscribed, tabID)
+		}
+		delete(h.viewers, tabID)
+		return
+	}
+	delete(client.subscribed, tabID)
+	delete(h.viewers[tabID], client)
+	if len(h.viewers[tabID]) == 0 {
+		delete(h.viewers, tabID)
+	}
+}
+
+// viewersOf returns how many clients are subscribed to tabID and the sorted
+// names of those that gave one.
+func (h *Hub) viewersOf(tabID string) (int, []string) {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	names := []string{}
+	for _, name := range h.viewers[tabID] {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return len(h.viewers[tabID]), names
+}
+
+// presence returns the number of clients subscribed to each tab that has
+// any.
+func (h *Hub) presence() map[string]int {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	counts := make(map[string]int, len(h.viewers))
+	for tabID, viewers := range h.viewers {
+		counts[tabID] = len(viewers)
+	}
+	return counts
+}
+
+// broadcastPresence sends every client the per-tab viewer counts whenever
+// they have changed, checking every interval.
+func (h *Hub) broadcastPresence(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := h.presence()
+	for range ticker.C {
+		counts := h.presence()
+		if maps.Equal(counts, last) {
+			continue
+		}
+		last = counts
+		h.sendAll(Message{Type: "presence", Presence: counts})
+	}
+}
+
+func (h *Hub) clientByID(id string) *Client {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	return h.byID[id]
+}
+
+// sendAll delivers msg directly to every connected client, bypassing the
+// broadcast queue, so it is safe to call from inside the hub loop.
+// Clients with a full send buffer miss it.
+func (h *Hub) sendAll(msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	for client := range h.clients {
+		select {
+		case client.send <- data:
+		default:
+		}
+	}
+}
+
+// storageHealthChanged warns clients when storage writes start failing, so
+// nobody assumes their edits are saved, and tells them when writes recover.
+func (h *Hub) storageHealthChanged(err error) {
+	if err != nil {
+		log.Printf("Storage writes failing, changes are not being persisted: %v", err)
+		h.sendAll(Message{Type: "storage", Error: "changes are not being saved: " + err.Error()})
+		return
+	}
+	log.Printf("Storage writes recovered")
+	h.sendAll(Message{Type: "storage"})
+}
+
+// disconnectIdle periodically drops clients that have been inactive for
+// longer than timeout, telling them why in the close frame.
+func (h *Hub) disconnectIdle(timeout time.Duration) {
+	ticker := time.NewTicker(max(timeout/4, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-timeout).UnixNano()
+		var idle []*Client
+
+		h.clientsMu.RLock()
+		for client := range h.clients {
+			if client.lastActive.Load() < cutoff {
+				idle = append(idle, client)
+			}
+		}
+		h.clientsMu.RUnlock()
+
+		for _, client := range idle {
+			if h.closeClient(client, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout")) {
+				log.Printf("[%s] Idle for %s, disconnecting client", client.id, timeout)
+			}
+		}
+	}
+}
+
+// disconnectExpired periodically drops clients whose session has expired
+// or was logged out, with close code closeSessionExpired. Clients whose
+// session expires within --session-expiry-warning are first sent a
+// token-expiring message, once.
+func (h *Hub) disconnectExpired() {
+	interval := time.Minute
+	if *expiryWarn > 0 && *expiryWarn/2 < interval {
+		interval = max(*expiryWarn/2, time.Second)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired, expiring []*Client
+		var expiries []time.Time
+		h.clientsMu.RLock()
+		for client := range h.clients {
+			if client.session == "" {
+				continue
+			}
+			if !validateSession(client.session) {
+				expired = append(expired, client)
+				continue
+			}
+			expiry, _ := sessionExpiry(client.session)
+			if *expiryWarn > 0 && !client.expiryWarned && time.Until(expiry) <= *expiryWarn {
+				client.expiryWarned = true
+				expiring = append(expiring, client)
+				expiries = append(expiries, expiry)
+			}
+		}
+		h.clientsMu.RUnlock()
+
+		for i, client := range expiring {
+			h.reply(client, Message{Type: "token-expiring", ExpiresAt: &expiries[i]})
+		}
+
+		for _, client := range expired {
+			if h.closeClient(client, websocket.FormatCloseMessage(closeSessionExpired, "session expired")) {
+				log.Printf("[%s] Session expired, disconnecting client", client.id)
+			}
+		}
+	}
+}
+
+// closeAll tells every WebSocket client the server is going away, each
+// with its own suggested reconnect delay. The close frames are written
+// directly, as the process is about to exit.
+func (h *Hub) closeAll() {
+	deadline := time.Now().Add(time.Second)
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	for client := range h.clients {
+		if client.conn != nil {
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, retryReason("server shutting down"))
+			client.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+		}
+	}
+}
+
+// closeStreams ends every /api/events stream. http.Server.Shutdown waits for
+// handlers to return without cancelling their requests, so main registers
+// this with RegisterOnShutdown.
+func (h *Hub) closeStreams() {
+	var streams []*Client
+	h.clientsMu.RLock()
+	for client := range h.clients {
+		if client.conn == nil {
+			streams = append(streams, client)
+		}
+	}
+	h.clientsMu.RUnlock()
+	for _, client := range streams {
+		h.closeClient(client, nil)
+	}
+}
+
+// saveContent persists a content change and marks the tab for debounced
+// history. With --save-interval set, the write is deferred to the next
+// flush instead. The caller must hold h.mu.
+func (h *Hub) saveContent(tab *Tab) {
+	h.dirty[tab.ID] = time.Now()
+	if *saveInterval > 0 {
+		tab.Updated = time.Now()
+		h.unsaved[tab.ID] = true
+		return
+	}
+	h.storage.SaveTab(tab)
+}
+
+// flush writes every tab with deferred content changes to storage.
+func (h *Hub) flush() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.flushLocked()
+}
+
+// checkpoint writes deferred tab content and a history entry for every
+// tab, then checkpoints the SQLite log, so the data directory can be copied
+// as a consistent backup. It returns the number of tabs flushed and
+// versioned.
+func (h *Hub) checkpoint() (flushed, versioned int) {
+	h.mu.Lock()
+	flushed = h.flushLocked()
+	for id, tab := range h.tabs {
+		if err := h.storage.SaveHistory(id, tab.Content); err != nil {
+			log.Printf("Failed to save history for tab %s: %v", id, err)
+			continue
+		}
+		delete(h.dirty, id)
+		versioned++
+	}
+	h.mu.Unlock()
+
+	if err := h.storage.Checkpoint(); err != nil {
+		log.Printf("WAL checkpoint failed: %v", err)
+	}
+	return flushed, versioned
+}
+
+// flushLocked is flush for callers that already hold h.mu.
+func (h *Hub) flushLocked() int {
+	saved := 0
+	for id := range h.unsaved {
+		if tab, exists := h.tabs[id]; exists {
+			if err := h.storage.SaveTab(tab); err != nil {
+				log.Printf("Failed to save tab %s: %v", id, err)
+				continue
+			}
+			saved++
+		}
+		delete(h.unsaved, id)
+	}
+	return saved
+}
+
+// ackFor builds the reply to a message that carried ackID: an ack once it
+// has been applied and written to storage, or a nack with the reason it was
+// rejected or not saved. Acknowledged edits skip --save-interval so the ack
+// is truthful. The caller must hold h.mu.
+func (h *Hub) ackFor(ackID, failure string, rejected bool) Message {
+	if failure == "" && rejected {
+		failure = "rejected"
+	}
+	if failure == "" {
+		h.flushLocked()
+		if err := h.storage.WriteError(); err != nil {
+			failure = "not saved: " + err.Error()
+		}
+	}
+	if failure != "" {
+		return Message{Type: "nack", AckID: ackID, Error: failure}
+	}
+	return Message{Type: "ack", AckID: ackID}
+}
+
+func (h *Hub) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.flush()
+	}
+}
+
+// slugify turns a tab name into a lowercase, hyphenated, URL-safe ID.
+func slugify(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			hyphen = false
+		} else if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "tab"
+	}
+	return slug
+}
+
+// uniqueSlug derives a tab ID from name, adding a numeric suffix when the
+// slug is already taken by an active or archived tab. The caller must hold
+// h.mu.
+func (h *Hub) uniqueSlug(name string) string {
+	base := slugify(name)
+	id := base
+	for n := 2; ; n++ {
+		if _, exists := h.tabs[id]; !exists {
+			if _, err := h.storage.GetTab(id); err != nil {
+				return id
+			}
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// nameTaken reports whether an active tab other than exceptID already uses
+// name, ignoring case. The caller must hold h.mu.
+func (h *Hub) nameTaken(name, exceptID string) bool {
+	for id, tab := range h.tabs {
+		if id != exceptID && strings.EqualFold(tab.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimName returns the name to use for tab exceptID: the cleaned name
+// itself if free, otherwise "name (2)", "name (3)"... with
+// --tab-name-conflict=suffix, or an error with the default reject policy.
+// The caller must hold h.mu.
+func (h *Hub) claimName(name, exceptID string) (string, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return "", err
+	}
+	if !h.nameTaken(name, exceptID) {
+		return name, nil
+	}
+	if *nameConflict != "suffix" {
+		return "", fmt.Errorf("a tab named %q already exists", name)
+	}
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)", name, n)
+		if !h.nameTaken(candidate, exceptID) {
+			return candidate, nil
+		}
+	}
+}
+
+func (h *Hub) run() {
+	for {
+		h.queuePending()
+		select {
+		case client := <-h.register:
+			h.addClient(client)
+			tabs := h.tabList()
+			for _, tab := range tabs {
+				tab.Version = h.versions[tab.ID]
+				if client.metadataInit {
+					tab.Content, tab.Locales = "", nil
+				}
+			}
+			msg, _ := json.Marshal(Message{
+				Type:        "init",
+				Tabs:        tabs,
+				Presence:    h.presence(),
+				Metadata:    client.metadataInit,
+				Maintenance: h.maintenance.Load(),
+			})
+			client.send <- msg
+			log.Printf("[%s] Client connected. Total clients: %d", client.id, h.clientCount())
+
+		case client := <-h.unregister:
+			if h.removeClient(client) {
+				log.Printf("[%s] Client disconnected. Total clients: %d", client.id, h.clientCount())
+			}
+			h.releaseClaims(client)
+
+		case in := <-h.broadcast:
+			message := in.message
+			var skip *Client          // not sent the relayed message
+			var update *contentUpdate // a content update, relayed by relayUpdate
+			if !utf8.Valid(message) {
+				if *invalidUTF8 != "replace" {
+					log.Printf("Rejected message with invalid UTF-8")
+					h.reply(in.from, Message{Type: "error", Error: "message is not valid UTF-8"})
+					continue
+				}
+				message = bytes.ToValidUTF8(message, []byte("\uFFFD"))
+			}
+			var msg Message
+			if err := json.Unmarshal(message, &msg); err == nil {
+				out := message
+				// reject reports why a client message was refused: as an
+				// error reply, or in the nack when the sender asked for
+				// an acknowledgement.
+				failure := ""
+				handled := false // applied, or answered to the sender alone, with nothing to relay
+				reject := func(reply Message) {
+					failure = reply.Error
+					if msg.AckID == "" {
+						h.reply(in.from, reply)
+					}
+				}
+				op := msg.Type
+				if in.from != nil && in.from.readOnly && !kioskMessages[op] {
+					reject(Message{Type: "error", TabID: msg.TabID, Error: "this connection is read-only"})
+					out, op = nil, ""
+				} else if in.from != nil && h.maintenance.Load() && !kioskMessages[op] {
+					reject(Message{Type: "error", TabID: msg.TabID, Error: "the board is read-only for maintenance"})
+					out, op = nil, ""
+				}
+				h.mu.Lock()
+				if claim, ok := h.claimedBy(in.from, msg); ok && claimedMessages[op] {
+					reject(Message{Type: "error", TabID: msg.TabID, Name: claim.name, Error: claim.describe()})
+					out, op = nil, ""
+				}
+				switch op {
+				case "update":
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						base := tab.Content
+						if len(msg.Patches) > 0 {
+							// Partial update: apply the delta and relay the
+							// resulting full content to all clients.
+							content, err := applyPatches(tab.Content, msg.Patches)
+							if err != nil {
+								log.Printf("Rejected patch for tab %s: %v", tab.ID, err)
+								failure = err.Error()
+								out = nil
+								break
+							}
+							msg.Content = content
+						}
+						if looksBinary(msg.Content) {
+							reject(Message{Type: "error", TabID: tab.ID, Error: errBinaryContent.Error()})
+							out = nil
+							break
+						}
+						if err := checkImageLimit(tab.Content, msg.Content); err != nil {
+							reject(Message{Type: "error", TabID: tab.ID, Error: err.Error()})
+							out = nil
+							break
+						}
+						msg.Content = transformContent(msg.Content)
+						if tab.Content != "" && msg.Content == "" {
+							h.recordActivity(tab.ID, "cleared", "")
+						}
+						tab.Content = msg.Content
+						h.saveContent(tab)
+						h.webhooks.Notify("updated", tab)
+						chars, words := textCounts(tab.Content)
+						h.versions[tab.ID]++
+						full := Message{Type: "update", TabID: tab.ID, Content: tab.Content, Chars: chars, Words: words, Locales: tab.localeCodes(), Version: h.versions[tab.ID]}
+						out, _ = json.Marshal(full)
+						update = &contentUpdate{message: out, full: full, base: base, baseVersion: full.Version - 1}
+					}
+				case "create":
+					name, err := h.claimName(msg.Name, msg.TabID)
+					if err != nil {
+						reject(Message{Type: "error", Name: msg.Name, Error: err.Error()})
+						out = nil
+						break
+					}
+					if name != msg.Name {
+						msg.Name = name
+						out, _ = json.Marshal(msg)
+					}
+					if msg.TabID == "" {
+						msg.TabID = h.uniqueSlug(msg.Name)
+						out, _ = json.Marshal(msg)
+					}
+					newTab := &Tab{
+						ID:      msg.TabID,
+						Name:    msg.Name,
+						Content: newTabContent,
+					}
+					if newTab.Content != "" {
+						msg.Content = newTab.Content
+						msg.Chars, msg.Words = textCounts(newTab.Content)
+						out, _ = json.Marshal(msg)
+					}
+					if msg.Template != "" {
+						if tpl, err := h.storage.GetTemplate(msg.Template); err == nil {
+							newTab.Content = transformContent(tpl.Content)
+							msg.Content = newTab.Content
+							msg.Chars, msg.Words = textCounts(newTab.Content)
+							out, _ = json.Marshal(msg)
+						} else {
+							log.Printf("Template %q not found for new tab %s", msg.Template, msg.TabID)
+						}
+					}
+					h.tabs[newTab.ID] = newTab
+					h.storage.SaveTab(newTab)
+					h.webhooks.Notify("created", newTab)
+					h.recordActivity(newTab.ID, "created", fmt.Sprintf("as %q", newTab.Name))
+				case "append":
+					// Applied under the hub lock so concurrent appends never
+					// race; only the fragment is broadcast, with the counts
+					// for the whole tab.
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						if looksBinary(msg.Content) {
+							reject(Message{Type: "error", TabID: tab.ID, Error: errBinaryContent.Error()})
+							out = nil
+							break
+						}
+						if err := checkImageLimit(tab.Content, tab.Content+msg.Content); err != nil {
+							reject(Message{Type: "error", TabID: tab.ID, Error: err.Error()})
+							out = nil
+							break
+						}
+						base := tab.Content
+						tab.Content = transformContent(tab.Content + msg.Content)
+						h.saveContent(tab)
+						h.webhooks.Notify("updated", tab)
+						chars, words := textCounts(tab.Content)
+						if fragment, ok := strings.CutPrefix(tab.Content, base); ok {
+							msg.Content, msg.Chars, msg.Words = fragment, chars, words
+							out, _ = json.Marshal(msg)
+							break
+						}
+						// A transform changed text before the fragment, e.g. a
+						// secret split across appends was redacted, so clients
+						// need the whole content.
+						h.versions[tab.ID]++
+						full := Message{Type: "update", TabID: tab.ID, Content: tab.Content, Chars: chars, Words: words, Locales: tab.localeCodes(), Version: h.versions[tab.ID]}
+						out, _ = json.Marshal(full)
+						update = &contentUpdate{message: out, full: full, base: base, baseVersion: full.Version - 1}
+					}
+				case "rename":
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						name, err := h.claimName(msg.Name, tab.ID)
+						if err != nil {
+							reject(Message{Type: "error", TabID: tab.ID, Name: msg.Name, Error: err.Error()})
+							out = nil
+							break
+						}
+						if name != msg.Name {
+							msg.Name = name
+							out, _ = json.Marshal(msg)
+						}
+						if tab.Name != msg.Name {
+							h.recordActivity(tab.ID, "renamed", fmt.Sprintf("from %q to %q", tab.Name, msg.Name))
+						}
+						tab.Name = msg.Name
+						h.storage.SaveTab(tab)
+						h.webhooks.Notify("renamed", tab)
+					}
+				case "delete":
+					// Clients delete in two steps, delete-request and
+					// delete-confirm, so one stray message can't remove a
+					// tab. A bare delete only comes from the server itself,
+					// e.g. the primary in follower mode.
+					if in.from != nil {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "send delete-request, then delete-confirm with the returned token"})
+						out = nil
+						break
+					}
+					h.deleteTab(msg.TabID)
+				case "delete-request":
+					out = nil
+					if _, exists := h.tabs[msg.TabID]; !exists {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "no such tab"})
+						break
+					}
+					token := h.deleteToken(msg.TabID, in.from)
+					h.reply(in.from, Message{Type: "delete-token", TabID: msg.TabID, Token: token})
+					handled = true
+				case "get":
+					// Content of one tab, for clients whose init left it
+					// out. Only the sender gets it.
+					out = nil
+					tab, exists := h.tabs[msg.TabID]
+					if !exists {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "no such tab"})
+						break
+					}
+					t := *tab
+					t.countText()
+					t.Version = h.versions[t.ID]
+					h.reply(in.from, Message{Type: "tab", TabID: t.ID, Tabs: []*Tab{&t}})
+					handled = true
+				case "hello":
+					// Capability negotiation: the reply lists the
+					// capabilities the server will use for this client.
+					out = nil
+					if in.from == nil {
+						break
+					}
+					in.from.delta = slices.Contains(msg.Capabilities, "delta")
+					reply := Message{Type: "hello"}
+					if in.from.delta {
+						reply.Capabilities = []string{"delta"}
+					}
+					h.reply(in.from, reply)
+					handled = true
+				case "subscribe", "unsubscribe":
+					// Viewer tracking only; broadcasts still go to every
+					// client.
+					out = nil
+					if in.from == nil {
+						break
+					}
+					if _, exists := h.tabs[msg.TabID]; !exists && op == "subscribe" {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "no such tab"})
+						break
+					}
+					if op == "subscribe" {
+						name, _ := cleanName(msg.Name) // anonymous when missing or invalid
+						if err := h.subscribe(in.from, msg.TabID, name); err != nil {
+							reject(Message{Type: "error", TabID: msg.TabID, Error: err.Error()})
+							break
+						}
+					} else {
+						h.unsubscribe(in.from, msg.TabID)
+					}
+					handled = true
+				case "claim":
+					out = nil
+					if in.from == nil {
+						break
+					}
+					if _, exists := h.tabs[msg.TabID]; !exists {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "no such tab"})
+						break
+					}
+					if claim, ok := h.claims[msg.TabID]; ok && claim.client != in.from {
+						reject(Message{Type: "error", TabID: msg.TabID, Name: claim.name, Error: claim.describe()})
+						break
+					}
+					name, _ := cleanName(msg.Name) // anonymous when missing or invalid
+					h.claims[msg.TabID] = tabClaim{client: in.from, name: name}
+					out, _ = json.Marshal(Message{Type: "claim", TabID: msg.TabID, Name: name})
+				case "release":
+					claim, ok := h.claims[msg.TabID]
+					if !ok || claim.client != in.from {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "tab is not claimed by this connection"})
+						out = nil
+						break
+					}
+					delete(h.claims, msg.TabID)
+					out, _ = json.Marshal(Message{Type: "release", TabID: msg.TabID})
+				case "ping":
+					// Echoed to the sender at once so clients can time the
+					// round trip. Clients report their last measurement in
+					// latency (ms); both feed GET /api/stats.
+					out = nil
+					if in.from != nil {
+						h.hubDelay.add(time.Since(in.queued))
+						if msg.Latency > 0 {
+							h.rtt.add(time.Duration(msg.Latency * float64(time.Millisecond)))
+						}
+					}
+					h.reply(in.from, Message{Type: "pong", Timestamp: msg.Timestamp})
+					handled = true
+				case "viewers":
+					out = nil
+					count, names := h.viewersOf(msg.TabID)
+					h.reply(in.from, Message{Type: "viewers", TabID: msg.TabID, Count: count, Names: names})
+					handled = true
+				case "delete-confirm":
+					pending, ok := h.deletes[msg.Token]
+					delete(h.deletes, msg.Token)
+					if !ok || pending.tabID != msg.TabID || pending.client != in.from || time.Now().After(pending.expires) {
+						reject(Message{Type: "error", TabID: msg.TabID, Error: "invalid or expired delete token"})
+						out = nil
+						break
+					}
+					h.deleteTab(msg.TabID)
+					out, _ = json.Marshal(Message{Type: "delete", TabID: msg.TabID})
+				case "archive":
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						tab.Archived = true
+						h.storage.SaveTab(tab)
+						h.recordActivity(tab.ID, "archived", "")
+						h.forgetTab(tab.ID)
+					}
+				case "set-language":
+					tab, exists := h.tabs[msg.TabID]
+					if !exists {
+						out = nil
+						break
+					}
+					if msg.Language != "" && !languages[msg.Language] {
+						reject(Message{Type: "error", TabID: tab.ID, Error: "unknown language"})
+						out = nil
+						break
+					}
+					tab.Language = msg.Language
+					h.storage.SaveTab(tab)
+				case "set-render-mode":
+					tab, exists := h.tabs[msg.TabID]
+					if !exists {
+						out = nil
+						break
+					}
+					if msg.RenderMode != "" && !renderModes[msg.RenderMode] {
+						reject(Message{Type: "error", TabID: tab.ID, Error: "unknown render mode"})
+						out = nil
+						break
+					}
+					tab.RenderMode = msg.RenderMode
+					h.storage.SaveTab(tab)
+				case "set-color":
+					tab, exists := h.tabs[msg.TabID]
+					if !exists {
+						break
+					}
+					color := ""
+					if msg.Color != "" {
+						var err error
+						if color, err = cleanColor(msg.Color); err != nil {
+							reject(Message{Type: "error", TabID: tab.ID, Error: err.Error()})
+							out = nil
+							break
+						}
+					}
+					tab.Color = color
+					h.storage.SaveTab(tab)
+					out, _ = json.Marshal(Message{Type: "set-color", TabID: tab.ID, Color: color})
+				case "move":
+					// Cut a range (or, without a length, everything) from the
+					// source tab and append it to the target in one step.
+					// Clients get both resulting tabs in a single message.
+					source, sourceOK := h.tabs[msg.SourceTabID]
+					target, targetOK := h.tabs[msg.TargetTabID]
+					if !sourceOK || !targetOK || source == target {
+						reject(Message{Type: "error", SourceTabID: msg.SourceTabID, TargetTabID: msg.TargetTabID, Error: "move needs two different existing tabs"})
+						out = nil
+						break
+					}
+					rest, cut := "", source.Content
+					if msg.Length > 0 {
+						var err error
+						rest, cut, err = cutRange(source.Content, msg.Offset, msg.Length)
+						if err != nil {
+							reject(Message{Type: "error", SourceTabID: source.ID, TargetTabID: target.ID, Error: err.Error()})
+							out = nil
+							break
+						}
+					}
+					if err := checkImageLimit(target.Content, target.Content+cut); err != nil {
+						reject(Message{Type: "error", SourceTabID: source.ID, TargetTabID: target.ID, Error: err.Error()})
+						out = nil
+						break
+					}
+					source.Content = transformContent(rest)
+					target.Content = transformContent(target.Content + cut)
+					h.saveContent(source)
+					h.saveContent(target)
+					h.webhooks.Notify("updated", source)
+					h.webhooks.Notify("updated", target)
+					src, dst := *source, *target
+					src.countText()
+					dst.countText()
+					out, _ = json.Marshal(Message{Type: "move", SourceTabID: source.ID, TargetTabID: target.ID, Tabs: []*Tab{&src, &dst}})
+				case "typing":
+					// Ephemeral: relayed to everyone but the sender and
+					// never stored. Clients expire the indicator themselves.
+					name, err := cleanName(msg.Name)
+					if _, exists := h.tabs[msg.TabID]; !exists || err != nil {
+						out = nil
+						break
+					}
+					out, _ = json.Marshal(Message{Type: "typing", TabID: msg.TabID, Name: name})
+					skip = in.from
+				case "pin", "unpin":
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						tab.Pinned = msg.Type == "pin"
+						h.storage.SaveTab(tab)
+					}
+				case "set-tags":
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						tab.Tags = normalizeTags(msg.Tags)
+						h.storage.SaveTab(tab)
+						msg.Tags = tab.Tags
+						out, _ = json.Marshal(msg)
+					}
+				case "set-locale-content":
+					// Translations are stored beside the primary content;
+					// empty content removes the locale.
+					tab, exists := h.tabs[msg.TabID]
+					if !exists {
+						break
+					}
+					if !validLocale(msg.Locale) {
+						reject(Message{Type: "error", TabID: tab.ID, Locale: msg.Locale, Error: "invalid locale code"})
+						out = nil
+						break
+					}
+					if looksBinary(msg.Content) {
+						reject(Message{Type: "error", TabID: tab.ID, Locale: msg.Locale, Error: errBinaryContent.Error()})
+						out = nil
+						break
+					}
+					msg.Content = transformContent(msg.Content)
+					locales := make(map[string]string, len(tab.Locales)+1)
+					for code, content := range tab.Locales {
+						locales[code] = content
+					}
+					if msg.Content == "" {
+						delete(locales, msg.Locale)
+					} else {
+						locales[msg.Locale] = msg.Content
+					}
+					tab.Locales = locales
+					h.saveContent(tab)
+					out, _ = json.Marshal(Message{Type: "set-locale-content", TabID: tab.ID, Locale: msg.Locale, Content: msg.Content, Locales: tab.localeCodes()})
+				case "set-encrypted":
+					tab, exists := h.tabs[msg.TabID]
+					if !exists {
+						out = nil
+						break
+					}
+					if h.storage.aead == nil {
+						reject(Message{Type: "error", TabID: tab.ID, Error: "encryption at rest is not configured"})
+						out = nil
+						break
+					}
+					tab.Encrypted = msg.Encrypted
+					h.storage.SaveTab(tab)
+					delete(h.unsaved, tab.ID)
+					if err := h.storage.ResealHistory(tab.ID); err != nil {
+						log.Printf("Failed to re-encrypt history for tab %s: %v", tab.ID, err)
+					}
+					out, _ = json.Marshal(Message{Type: "set-encrypted", TabID: tab.ID, Encrypted: tab.Encrypted})
+				case "label-history":
+					// Name (or, with an empty label, unname) one history
+					// entry of the tab, e.g. to mark a known-good version.
+					label := strings.TrimSpace(msg.Label)
+					if label != "" {
+						var err error
+						if label, err = cleanName(label); err != nil {
+							reject(Message{Type: "error", TabID: msg.TabID, HistoryID: msg.HistoryID, Error: err.Error()})
+							out = nil
+							break
+						}
+					}
+					found, err := h.storage.LabelHistory(msg.TabID, msg.HistoryID, label)
+					if err != nil {
+						log.Printf("Failed to label history %d of tab %s: %v", msg.HistoryID, msg.TabID, err)
+						reject(Message{Type: "error", TabID: msg.TabID, HistoryID: msg.HistoryID, Error: "failed to save label"})
+						out = nil
+						break
+					}
+					if !found {
+						reject(Message{Type: "error", TabID: msg.TabID, HistoryID: msg.HistoryID, Error: "history entry not found"})
+						out = nil
+						break
+					}
+					out, _ = json.Marshal(Message{Type: "label-history", TabID: msg.TabID, HistoryID: msg.HistoryID, Label: label})
+				case "set-expiry":
+					if tab, exists := h.tabs[msg.TabID]; exists {
+						tab.ExpiresAt = msg.ExpiresAt
+						h.storage.SaveTab(tab)
+					}
+				case "expire":
+					// Queued by expireTabs; the deadline is re-checked here so
+					// an early or repeated request is a no-op.
+					tab, exists := h.tabs[msg.TabID]
+					if in.from != nil || !exists || tab.ExpiresAt == nil || time.Now().Before(*tab.ExpiresAt) {
+						out = nil
+						break
+					}
+					if *expiryAction == "delete" {
+						h.deleteTab(tab.ID)
+						out, _ = json.Marshal(Message{Type: "delete", TabID: tab.ID})
+					} else {
+						// Sent like any other update, so delta clients can
+						// follow it with patches.
+						base := tab.Content
+						tab.Content = ""
+						tab.ExpiresAt = nil
+						h.saveContent(tab)
+						h.recordActivity(tab.ID, "cleared", "expired")
+						h.webhooks.Notify("updated", tab)
+						chars, words := textCounts(tab.Content)
+						h.versions[tab.ID]++
+						full := Message{Type: "update", TabID: tab.ID, Content: tab.Content, Chars: chars, Words: words, Locales: tab.localeCodes(), Version: h.versions[tab.ID]}
+						out, _ = json.Marshal(full)
+						update = &contentUpdate{message: out, full: full, base: base, baseVersion: full.Version - 1}
+					}
+					log.Printf("Tab %s expired (%s)", tab.ID, *expiryAction)
+				case "init":
+					// Only the upstream connection sends init, and only in
+					// follower mode: replace the mirror with the primary's
+					// tabs and pass the init on to local viewers.
+					if *upstreamURL == "" || in.from != nil {
+						out = nil
+						break
+					}
+					tabs := make(map[string]*Tab, len(msg.Tabs))
+					for _, tab := range msg.Tabs {
+						tabs[tab.ID] = tab
+						h.storage.SaveTab(tab)
+					}
+					for id := range h.tabs {
+						if _, exists := tabs[id]; !exists {
+							h.storage.DeleteTab(id)
+						}
+					}
+					h.tabs = tabs
+					h.unsaved = make(map[string]bool)
+				case "import":
+					// Queued by importTab once the tab is stored, so only
+					// relayed; a follower mirrors the primary's import.
+					if in.from != nil {
+						reject(Message{Type: "error", Error: "import tabs with POST /api/tabs/import"})
+						out = nil
+						break
+					}
+					if *upstreamURL != "" {
+						for _, tab := range msg.Tabs {
+							h.tabs[tab.ID] = tab
+							h.storage.SaveTab(tab)
+						}
+					}
+				case "unarchive":
+					// Clients no longer hold archived tabs, so the broadcast
+					// carries the restored tab in full.
+					if tab, err := h.storage.GetTab(msg.TabID); err == nil && tab.Archived {
+						tab.Archived = false
+						h.storage.SaveTab(tab)
+						h.recordActivity(tab.ID, "restored", "from archive")
+						h.tabs[tab.ID] = tab
+						t := *tab
+						out, _ = json.Marshal(Message{Type: "unarchive", TabID: tab.ID, Tabs: []*Tab{&t}})
+					}
+				default:
+					// The server's own messages (announcement, maintenance,
+					// presence and the like) are relayed as they are, but
+					// clients may not send them or anything unknown.
+					if in.from != nil && out != nil {
+						reject(Message{Type: "error", Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+						out = nil
+					}
+				}
+				var ack Message
+				if msg.AckID != "" && in.from != nil {
+					ack = h.ackFor(msg.AckID, failure, out == nil && !handled)
+				}
+				h.mu.Unlock()
+				if ack.Type != "" {
+					h.reply(in.from, ack)
+				}
+				if out == nil {
+					continue
+				}
+				message = out
+			}
+
+			if msg.Type == "update" && *coalesce > 0 {
+				if update == nil {
+					update = &contentUpdate{message: message}
+				}
+				if h.hold(msg.TabID, *update) {
+					continue
+				}
+			} else {
+				// Keep clients in order: an update still being held must
+				// not arrive after a later append, rename or delete.
+				for tabID := range h.held {
+					h.releaseHeld(tabID)
+				}
+			}
+			if update != nil {
+				h.relayUpdate(*update)
+				continue
+			}
+			h.fanOut(message, skip)
+
+		case done := <-h.resets:
+			done <- h.reset()
+
+		case tabID := <-h.release:
+			if time.Since(h.lastSent[tabID]) >= *coalesce {
+				h.releaseHeld(tabID)
+			}
+
+		case <-h.pendingReady:
+			// Parked updates are queued at the top of the loop.
+		}
+	}
+}
+
+// importTab adds an exported tab and its history to the board, remapping
+// its ID when already in use, and tells clients about it.
+func (h *Hub) importTab(tab *Tab, history []HistoryRecord) (*Tab, error) {
+	h.mu.Lock()
+	name, err := h.claimName(tab.Name, "")
+	if err != nil {
+		h.mu.Unlock()
+		return nil, err
+	}
+	tab.Name = name
+	if _, exists := h.tabs[tab.ID]; exists || tab.ID == "" {
+		tab.ID = h.uniqueSlug(tab.Name)
+	} else if _, err := h.storage.GetTab(tab.ID); err == nil {
+		tab.ID = h.uniqueSlug(tab.Name)
+	}
+	tab.Archived = false
+	tab.Content = transformContent(tab.Content)
+	for i := range history {
+		history[i].Content = eolContent(history[i].Content)
+	}
+	h.tabs[tab.ID] = tab
+	if err := h.storage.SaveTab(tab); err != nil {
+		delete(h.tabs, tab.ID)
+		h.mu.Unlock()
+		return nil, err
+	}
+	if err := h.storage.ImportHistory(tab.ID, history); err != nil {
+		log.Printf("Failed to import history for tab %s: %v", tab.ID, err)
+	}
+	h.webhooks.Notify("created", tab)
+	h.recordActivity(tab.ID, "created", fmt.Sprintf("imported as %q", tab.Name))
+	t := *tab
+	h.mu.Unlock()
+
+	t.countText()
+	msg, _ := json.Marshal(Message{Type: "import", TabID: t.ID, Tabs: []*Tab{&t}})
+	h.enqueue(msg)
+	return tab, nil
+}
+
+// deleteTab removes a tab for good. The caller must hold h.mu.
+func (h *Hub) deleteTab(tabID string) {
+	if tab, exists := h.tabs[tabID]; exists {
+		h.webhooks.Notify("deleted", tab)
+	}
+	h.forgetTab(tabID)
+	h.storage.DeleteTab(tabID)
+}
+
+// forgetTab drops tabID from the active tabs along with its pending saves,
+// version, claim and viewers, once it has been deleted or archived. The
+// caller must hold h.mu.
+func (h *Hub) forgetTab(tabID string) {
+	delete(h.tabs, tabID)
+	delete(h.versions, tabID)
+	delete(h.dirty, tabID)
+	delete(h.unsaved, tabID)
+	delete(h.claims, tabID)
+
+	h.clientsMu.Lock()
+	h.dropViewer(tabID, nil)
+	h.clientsMu.Unlock()
+}
+
+// claimedBy returns the claim held by another client on a tab msg edits.
+// Server messages are never refused. The caller must hold h.mu.
+func (h *Hub) claimedBy(from *Client, msg Message) (tabClaim, bool) {
+	if from == nil {
+		return tabClaim{}, false
+	}
+	for _, tabID := range []string{msg.TabID, msg.SourceTabID, msg.TargetTabID} {
+		if claim, ok := h.claims[tabID]; ok && claim.client != from {
+			return claim, true
+		}
+	}
+	return tabClaim{}, false
+}
+
+func (c tabClaim) describe() string {
+	if c.name == "" {
+		return "tab is being edited by another client"
+	}
+	return fmt.Sprintf("tab is being edited by %s", c.name)
+}
+
+// releaseClaims drops every claim held by client, which has disconnected,
+// and tells the remaining clients the tabs are free again.
+func (h *Hub) releaseClaims(client *Client) {
+	h.mu.Lock()
+	var released []string
+	for tabID, claim := range h.claims {
+		if claim.client == client {
+			delete(h.claims, tabID)
+			released = append(released, tabID)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, tabID := range released {
+		msg, _ := json.Marshal(Message{Type: "release", TabID: tabID})
+		h.fanOut(msg, nil)
+	}
+}
+
+// deleteToken issues the token client must send back in delete-confirm
+// within deleteTokenTTL to delete tabID. Expired tokens are dropped here.
+// The caller must hold h.mu.
+func (h *Hub) deleteToken(tabID string, client *Client) string {
+	now := time.Now()
+	for token, pending := range h.deletes {
+		if now.After(pending.expires) {
+			delete(h.deletes, token)
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	h.deletes[token] = pendingDelete{tabID: tabID, client: client, expires: now.Add(deleteTokenTTL)}
+	return token
+}
+
+// recordActivity adds an entry to the tab's changelog. Failures are logged
+// and otherwise ignored; the changelog is informational.
+func (h *Hub) recordActivity(tabID, event, detail string) {
+	if err := h.storage.AddActivity(tabID, event, detail); err != nil {
+		log.Printf("Failed to record %s activity for tab %s: %v", event, tabID, err)
+	}
+}
+
+// fanOut sends message to every client except skip, disconnecting clients
+// whose send buffer is full.
+func (h *Hub) fanOut(message []byte, skip *Client) {
+	h.fanOutEach(skip, func(*Client) []byte { return message })
+}
+
+// fanOutEach is fanOut with a message chosen per client.
+func (h *Hub) fanOutEach(skip *Client, messageFor func(*Client) []byte) {
+	h.clientsMu.RLock()
+	var slow []*Client
+	for client := range h.clients {
+		if client == skip {
+			continue
+		}
+		select {
+		case client.send <- messageFor(client):
+		default:
+			slow = append(slow, client)
+		}
+	}
+	h.clientsMu.RUnlock()
+
+	for _, client := range slow {
+		log.Printf("[%s] Send buffer full, disconnecting client", client.id)
+		h.closeClient(client, websocket.FormatCloseMessage(closeTooSlow, retryReason("send buffer full")))
+	}
+}
+
+// hold reports whether an update to tabID should wait because another was
+// relayed less than --coalesce-updates ago. A held update replaces any
+// earlier one still waiting, so only the latest content goes out, patched
+// from the content clients were last sent. The tab itself is already
+// updated and saved; only the relay is delayed.
+func (h *Hub) hold(tabID string, update contentUpdate) bool {
+	if earlier, waiting := h.held[tabID]; !waiting {
+		wait := *coalesce - time.Since(h.lastSent[tabID])
+		if wait <= 0 {
+			h.lastSent[tabID] = time.Now()
+			return false
+		}
+		time.AfterFunc(wait, func() { h.release <- tabID })
+	} else if earlier.full.Type != "" {
+		update.base, update.baseVersion = earlier.base, earlier.baseVersion
+	}
+	h.held[tabID] = update
+	return true
+}
+
+// releaseHeld relays the update held for tabID, if any.
+func (h *Hub) releaseHeld(tabID string) {
+	update, ok := h.held[tabID]
+	if !ok {
+		return
+	}
+	delete(h.held, tabID)
+	h.lastSent[tabID] = time.Now()
+	h.relayUpdate(update)
+}
+
+// contentUpdate is an update on its way to clients: message carries the
+// full content, and full the same update decoded. Clients that said hello
+// with the delta capability get a patch from base, the content they were
+// last sent, instead. full is zero for updates relayed as received, which
+// go to every client as they are.
+type contentUpdate struct {
+	message     []byte
+	full        Message
+	base        string
+	baseVersion uint64
+}
+
+// relayUpdate sends an update to every client. Delta clients get
+// {"type": "update", "patches": [...], "baseVersion": N, "version": N+1}
+// and should request the tab with get when their version isn't
+// baseVersion. The patch is built once, when the first delta client needs
+// it.
+func (h *Hub) relayUpdate(update contentUpdate) {
+	var patch []byte
+	h.fanOutEach(nil, func(client *Client) []byte {
+		if !client.delta || update.full.Type == "" {
+			return update.message
+		}
+		if patch == nil {
+			msg := update.full
+			msg.Content = ""
+			msg.Patches = []TextPatch{textDelta(update.base, update.full.Content)}
+			msg.BaseVersion = update.baseVersion
+			patch, _ = json.Marshal(msg)
+		}
+		return patch
+	})
+}
+
+// expireTabs periodically queues an expire message for every tab whose
+// expiry has passed.
+func (h *Hub) expireTabs(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if h.maintenance.Load() {
+			continue
+		}
+		now := time.Now()
+		var expired []string
+
+		h.mu.RLock()
+		for id, tab := range h.tabs {
+			if tab.ExpiresAt != nil && now.After(*tab.ExpiresAt) {
+				expired = append(expired, id)
+			}
+		}
+		h.mu.RUnlock()
+
+		for _, id := range expired {
+			msg, _ := json.Marshal(Message{Type: "expire", TabID: id})
+			h.enqueue(msg)
+		}
+	}
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	// Frames over the limit are refused while they are being read, before
+	// any of the message is buffered or parsed; the client is sent close
+	// code 1009 (message too big).
+	if *maxMessage > 0 {
+		c.conn.SetReadLimit(*maxMessage)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Printf("[%s] Message over %d bytes, disconnecting client", c.id, *maxMessage)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("[%s] error: %v", c.id, err)
+			}
+			break
+		}
+		c.lastActive.Store(time.Now().UnixNano())
+		if c.receiveOnly && !kioskMessages[messageType(message)] {
+			continue
+		}
+		c.hub.enqueueFrom(c, message)
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(54 * time.Second)
+	defer func() {
+		ticker.Stop()
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg)
+				return
+			}
+
+			w, err := c.conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return
+			}
+			w.Write(message)
+
+			n := len(c.send)
+			for i := 0; i < n; i++ {
+				w.Write([]byte{'\n'})
+				w.Write(<-c.send)
+			}
+
+			if err := w.Close(); err != nil {
+				return
+			}
+			if *idleActivity == "any" {
+				c.lastActive.Store(time.Now().UnixNano())
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sessionCookie builds the session cookie according to the cookie flags.
+// A negative maxAge clears it.
+func sessionCookie(value string, maxAge int) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch strings.ToLower(*cookieSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	return &http.Cookie{
+		Name:     "session_id",
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   *cookieSecure || sameSite == http.SameSiteNoneMode,
+		SameSite: sameSite,
+	}
+}
+
+// sessionFromRequest returns the session token from an Authorization: Bearer
+// header, falling back to the session cookie.
+func sessionFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if cookie, err := r.Cookie("session_id"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// Browsers can't set headers on WebSocket requests, so clients may pass the
+// session token as a subprotocol instead: they offer wsProtocol together
+// with wsTokenPrefix+token, and the server selects wsProtocol.
+const (
+	wsProtocol    = "boardcast"
+	wsTokenPrefix = "boardcast.token."
+)
+
+// wsSession returns the session token for a WebSocket upgrade request,
+// preferring the subprotocol header over the token query parameter, and
+// either over the Authorization header or cookie.
+func wsSession(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, wsTokenPrefix) {
+			return strings.TrimPrefix(protocol, wsTokenPrefix)
+		}
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return sessionFromRequest(r)
+}
+
+func handleAuth(pwd string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var req struct {
+				Password string `json:"password"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+
+			if req.Password == pwd {
+				sessionID := createSession()
+				
+				http.SetCookie(w, sessionCookie(sessionID, 86400)) // 24 hours
+
+				expiry, _ := sessionExpiry(sessionID)
+				resp := map[string]string{
+					"status":    "authenticated",
+					"expiresAt": expiry.UTC().Format(time.RFC3339),
+				}
+				if *tokenInBody {
+					resp["token"] = sessionID
+				}
+				json.NewEncoder(w).Encode(resp)
+				log.Printf("[%s] User authenticated successfully from %s", requestID(r), clientIP(r))
+			} else {
+				http.Error(w, "Invalid password", http.StatusUnauthorized)
+				log.Printf("[%s] Authentication failed from %s: invalid password", requestID(r), clientIP(r))
+			}
+		} else if r.Method == "DELETE" {
+			// Logout
+			if sessionID := sessionFromRequest(r); sessionID != "" {
+				deleteSession(sessionID)
+			}
+			
+			http.SetCookie(w, sessionCookie("", -1))
+			
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "logged_out",
+			})
+			log.Printf("[%s] User logged out", requestID(r))
+		} else if r.Method == "GET" {
+			// Check session
+			sessionID := sessionFromRequest(r)
+			if !validateSession(sessionID) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			expiry, _ := sessionExpiry(sessionID)
+			
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":    "authenticated",
+				"expiresAt": expiry.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+}
+
+// authMiddleware rejects requests without a valid session. Most endpoints
+// are wrapped with it in main; handleWebSocket checks the session itself.
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validateSession(sessionFromRequest(r)) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// connectLimiter enforces --ws-connect-rate, or is nil when disabled.
+var connectLimiter *rateLimiter
+
+func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if shedLoad(hub, w, r) {
+		return
+	}
+	if connectLimiter != nil {
+		if ok, retryAfter := connectLimiter.allow(clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "Too many connection attempts", http.StatusTooManyRequests)
+			log.Printf("[%s] Too many WebSocket connection attempts from %s", requestID(r), clientIP(r))
+			return
+		}
+	}
+
+	session := wsSession(r)
+	if !validateSession(session) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[%s] %v", requestID(r), err)
+		return
+	}
+	write, _ := originPermission(r)
+
+	client := &Client{
+		id:          requestID(r),
+		hub:         hub,
+		conn:        conn,
+		send:        make(chan []byte, *sendBuf),
+		remoteAddr:  clientIP(r),
+		connected:   time.Now(),
+		receiveOnly: *kiosk || *upstreamURL != "",
+		readOnly:    !write,
+		session:     session,
+
+		metadataInit: wsInitMode(r) == "metadata",
+	}
+	client.lastActive.Store(client.connected.UnixNano())
+	client.hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// wsInitMode returns the init mode a WebSocket client asked for with the
+// init query parameter, or --init-mode when it didn't ask.
+func wsInitMode(r *http.Request) string {
+	switch mode := r.URL.Query().Get("init"); mode {
+	case "full", "metadata":
+		return mode
+	}
+	return *initMode
+}
+
+// handleEvents streams hub broadcasts as server-sent events for clients that
+// can't use WebSockets. Each message is one event whose data is the same
+// JSON a WebSocket client would receive, starting with init. The stream is
+// receive-only.
+func handleEvents(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		if shedLoad(hub, w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		client := &Client{
+			id:          requestID(r),
+			hub:         hub,
+			send:        make(chan []byte, *sendBuf),
+			remoteAddr:  clientIP(r),
+			connected:   time.Now(),
+			receiveOnly: true,
+			session:     sessionFromRequest(r),
+		}
+		client.lastActive.Store(client.connected.UnixNano())
+		hub.register <- client
+		defer func() { hub.unregister <- client }()
+
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case message, ok := <-client.send:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "data: %s\n\n", message)
+				flusher.Flush()
+				// An open stream is a live viewer, so deliveries count as
+				// activity regardless of --idle-activity.
+				client.lastActive.Store(time.Now().UnixNano())
+
+			case <-ticker.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func handleTabs(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tabs := hub.tabList()
+		if since := r.URL.Query().Get("since"); since != "" {
+			// Incremental polling: read from the database, where every
+			// save stamps the tab. X-Server-Time is the since value for
+			// the next poll.
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				http.Error(w, "Invalid since: want an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			now := time.Now()
+			changed, err := hub.storage.LoadTabsSince(t, r.URL.Query().Get("archived") == "1")
+			if err != nil {
+				http.Error(w, "Failed to load tabs", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Server-Time", now.UTC().Format(time.RFC3339Nano))
+			tabs = changed
+		} else if r.URL.Query().Get("archived") == "1" {
+			archived, err := hub.storage.LoadArchivedTabs()
+			if err != nil {
+				http.Error(w, "Failed to load tabs", http.StatusInternalServerError)
+				return
+			}
+			tabs = archived
+		}
+
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			filtered := make([]*Tab, 0, len(tabs))
+			for _, tab := range tabs {
+				if tab.hasTag(tag) {
+					filtered = append(filtered, tab)
+				}
+			}
+			tabs = filtered
+		}
+
+		json.NewEncoder(w).Encode(tabs)
+	}
+}
+
+// handleTab serves the per-tab endpoints under /api/tabs/<id>/.
+func handleTab(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tabID, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/tabs/"), "/")
+		if tabID == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if tabID == "import" && resource == "" {
+			handleTabImport(hub, w, r)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch resource {
+		case "activity":
+			handleTabActivity(hub, tabID, w)
+		case "export":
+			handleTabExport(hub, tabID, w, r)
+		case "viewers":
+			count, names := hub.viewersOf(tabID)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"tabId": tabID,
+				"count": count,
+				"names": names,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// handleTabActivity serves GET /api/tabs/<id>/activity, the tab's
+// changelog in chronological order.
+func handleTabActivity(hub *Hub, tabID string, w http.ResponseWriter) {
+	activity, err := hub.storage.GetActivity(tabID)
+	if err != nil {
+		http.Error(w, "Failed to get activity", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(activity)
+}
 
-	for {
-		_, message, err := c.conn.ReadMessage()
+// tabBundle is a single tab as exported by GET /api/tabs/<id>/export and
+// accepted by POST /api/tabs/import.
+type tabBundle struct {
+	Tab     *Tab            `json:"tab"`
+	History []HistoryRecord `json:"history,omitempty"`
+}
+
+// handleTabExport serves GET /api/tabs/<id>/export, the tab and, with
+// include=history, all of its history as a tabBundle.
+func handleTabExport(hub *Hub, tabID string, w http.ResponseWriter, r *http.Request) {
+	var bundle tabBundle
+	hub.mu.RLock()
+	if tab, exists := hub.tabs[tabID]; exists {
+		t := *tab
+		bundle.Tab = &t
+	}
+	hub.mu.RUnlock()
+	if bundle.Tab == nil {
+		// Archived tabs are only in the database.
+		tab, err := hub.storage.GetTab(tabID)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
+			http.Error(w, "Tab not found", http.StatusNotFound)
+			return
+		}
+		bundle.Tab = tab
+	}
+	bundle.Tab.countText()
+
+	if r.URL.Query().Get("include") == "history" {
+		history, err := hub.storage.GetHistory(tabID, -1) // no limit
+		if err != nil {
+			http.Error(w, "Failed to get history", http.StatusInternalServerError)
+			return
 		}
-		c.hub.broadcast <- message
+		bundle.History = history
 	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", tabID+".json"))
+	json.NewEncoder(w).Encode(bundle)
 }
 
-func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
+// handleTabImport serves POST /api/tabs/import, recreating an exported tab
+// and its history. The tab keeps its ID unless that is taken, in which case
+// it gets a new one derived from its name.
+func handleTabImport(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+	var bundle tabBundle
+	if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil || bundle.Tab == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	name, err := cleanName(bundle.Tab.Name)
+	if err != nil {
+		http.Error(w, "Invalid name: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bundle.Tab.Name = name
+	if bundle.Tab.Color != "" {
+		if bundle.Tab.Color, err = cleanColor(bundle.Tab.Color); err != nil {
+			http.Error(w, "Invalid color: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
+	tab, err := hub.importTab(bundle.Tab, bundle.History)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	log.Printf("[%s] Imported tab %s with %d history entries", requestID(r), tab.ID, len(bundle.History))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": tab.ID, "name": tab.Name})
+}
+
+// handleIngest lets machine clients push content with a static API key
+// instead of a session. The change is queued through the hub like any
+// WebSocket message, so it is persisted and broadcast in order.
+func handleIngest(hub *Hub, apiKey string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(apiKey)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			TabID   string `json:"tabId"`
+			Content string `json:"content"`
+			Mode    string `json:"mode"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TabID == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		msgType := "update"
+		switch req.Mode {
+		case "", "replace":
+		case "append":
+			msgType = "append"
+		default:
+			http.Error(w, "Invalid mode", http.StatusBadRequest)
+			return
+		}
+
+		hub.mu.RLock()
+		_, exists := hub.tabs[req.TabID]
+		hub.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Tab not found", http.StatusNotFound)
+			return
+		}
+
+		msg, _ := json.Marshal(Message{
+			Type:    msgType,
+			TabID:   req.TabID,
+			Content: req.Content,
+		})
+		hub.enqueue(msg)
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "queued",
+		})
+	}
+}
+
+// resetConfirmation must be sent as "confirm" in the body of POST
+// /api/reset, so the endpoint can't be triggered by a stray request.
+const resetConfirmation = "delete all data"
+
+// handleReset wipes the board for a fresh start. Operator only.
+func handleReset(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Confirm string `json:"confirm"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Confirm != resetConfirmation {
+			http.Error(w, fmt.Sprintf("Send {\"confirm\": %q} to delete all tabs, history, snapshots and images", resetConfirmation), http.StatusBadRequest)
+			return
+		}
+
+		done := make(chan error)
+		hub.resets <- done
+		if err := <-done; err != nil {
+			log.Printf("[%s] Reset failed: %v", requestID(r), err)
+			http.Error(w, "Failed to reset", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[%s] All data reset by operator from %s", requestID(r), clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// maxAnnouncementLen caps announcements in characters; they are meant to be
+// a line or two in a banner.
+const maxAnnouncementLen = 1000
+
+// handleAnnounce sends {"type": "announcement", "content": "..."} to every
+// connected client, whatever tab it views. Announcements are not stored, so
+// clients that connect later don't see them. Operator only.
+func handleAnnounce(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		req.Message = strings.TrimSpace(req.Message)
+		if req.Message == "" {
+			http.Error(w, "message is required", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Message) > maxAnnouncementLen {
+			http.Error(w, fmt.Sprintf("message is longer than %d characters", maxAnnouncementLen), http.StatusBadRequest)
+			return
+		}
+
+		hub.sendAll(Message{Type: "announcement", Content: req.Message})
+		log.Printf("[%s] Announcement sent: %q", requestID(r), req.Message)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// operatorMiddleware guards operational endpoints with the admin token sent
+// in the X-Admin-Token header. They are disabled when no token is set.
+func operatorMiddleware(adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Operator access disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// operatorDelete sends DELETE requests to del behind the operator token and
+// everything else to next behind the session check, for endpoints whose
+// reads are open to users but whose bulk deletes are not.
+func operatorDelete(adminToken string, del, next http.HandlerFunc) http.HandlerFunc {
+	del = operatorMiddleware(adminToken, del)
+	next = authMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			del(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleClients(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/clients"), "/")
+
+		if r.Method == "GET" && id == "" {
+			type clientInfo struct {
+				ID         string    `json:"id"`
+				RemoteAddr string    `json:"remoteAddr"`
+				Connected  time.Time `json:"connected"`
 			}
-			w.Write(message)
 
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+			hub.clientsMu.RLock()
+			clients := make([]clientInfo, 0, len(hub.clients))
+			for client := range hub.clients {
+				clients = append(clients, clientInfo{
+					ID:         client.id,
+					RemoteAddr: client.remoteAddr,
+					Connected:  client.connected,
+				})
 			}
+			hub.clientsMu.RUnlock()
 
-			if err := w.Close(); err != nil {
+			json.NewEncoder(w).Encode(clients)
+		} else if r.Method == "DELETE" && id != "" {
+			client := hub.clientByID(id)
+			if client == nil {
+				http.Error(w, "Client not found", http.StatusNotFound)
 				return
 			}
 
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			hub.closeClient(client, websocket.FormatCloseMessage(closeKicked, "disconnected by operator"))
+			log.Printf("[%s] Client %s disconnected by operator", requestID(r), id)
+			w.WriteHeader(http.StatusOK)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func handleHistory(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tabID := r.URL.Query().Get("tabId")
+		if tabID == "" {
+			http.Error(w, "Missing tabId", http.StatusBadRequest)
+			return
+		}
+
+		// Requested limits are clamped to --history-max-limit; the
+		// effective one is returned in X-History-Limit.
+		limit := 20
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
 				return
 			}
+			limit = n
+		}
+		limit = min(limit, max(*historyLimit, 1))
+		history, err := hub.storage.GetHistory(tabID, limit)
+		if err != nil {
+			http.Error(w, "Failed to get history", http.StatusInternalServerError)
+			return
 		}
+
+		w.Header().Set("X-History-Limit", strconv.Itoa(limit))
+		json.NewEncoder(w).Encode(history)
 	}
 }
 
-func handleAuth(pwd string) http.HandlerFunc {
+// handleHistoryTimeline serves GET /api/history/timeline?tabId=<id>, all of
+// a tab's history as one plain-text document, oldest first, with a header
+// line before each version. With diff=1 each version after the first is
+// given as a unified diff against the one before. The document is written
+// as entries are read.
+func handleHistoryTimeline(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tabID := r.URL.Query().Get("tabId")
+		if tabID == "" {
+			http.Error(w, "Missing tabId", http.StatusBadRequest)
+			return
+		}
+		diffs := r.URL.Query().Get("diff") == "1"
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", tabID+"-timeline.txt"))
+		previous, n := "", 0
+		err := hub.storage.EachHistory(tabID, func(rec HistoryRecord) error {
+			body := rec.Content
+			if diffs && n > 0 {
+				body = unifiedDiff(previous, rec.Content)
+				if body == "" {
+					body = "(no changes)\n"
+				}
+			}
+			previous = rec.Content
+			n++
+			if !strings.HasSuffix(body, "\n") {
+				body += "\n"
+			}
+			_, err := fmt.Fprintf(w, "===== %s (version %d) =====\n%s\n", rec.Created.UTC().Format(time.RFC3339), n, body)
+			return err
+		})
+		if err != nil && n == 0 {
+			http.Error(w, "Failed to get history", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			log.Printf("[%s] History timeline for tab %s cut short: %v", requestID(r), tabID, err)
+		}
+	}
+}
+
+// parseBefore reads the before query parameter as an RFC 3339 timestamp or
+// a plain date (midnight UTC).
+func parseBefore(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("before")
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// handleHistoryPrune serves DELETE /api/history?before=<time>, removing
+// history entries older than the given time across all tabs.
+func handleHistoryPrune(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		before, err := parseBefore(r)
+		if err != nil {
+			http.Error(w, "Invalid or missing before", http.StatusBadRequest)
+			return
+		}
+
+		n, err := hub.storage.DeleteHistoryBefore(before)
+		if err != nil {
+			http.Error(w, "Failed to delete history", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[%s] Deleted %d history entries before %s", requestID(r), n, before.Format(time.RFC3339))
+		json.NewEncoder(w).Encode(map[string]int64{"deleted": n})
+	}
+}
+
+func handleSnapshot(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" {
+			if shedLoad(hub, w, r) {
+				return
+			}
 			var req struct {
-				Password string `json:"password"`
+				Name        string `json:"name"`
+				Description string `json:"description"`
+				Overwrite   bool   `json:"overwrite"`
 			}
 
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				http.Error(w, "Invalid request", http.StatusBadRequest)
 				return
 			}
+			name, err := cleanName(req.Name)
+			if err != nil {
+				http.Error(w, "Invalid name: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Name = name
 
-			if req.Password == pwd {
-				sessionID := createSession()
-				
-				http.SetCookie(w, &http.Cookie{
-					Name:     "session_id",
-					Value:    sessionID,
-					Path:     "/",
-					MaxAge:   86400, // 24 hours
-					HttpOnly: true,
-					SameSite: http.SameSiteLaxMode,
-				})
+			if *maxSnapshots > 0 && !snapshotRoom(hub, w, r, req.Name, req.Overwrite) {
+				return
+			}
 
-				json.NewEncoder(w).Encode(map[string]string{
-					"status": "authenticated",
-				})
-				log.Println("User authenticated successfully")
+			tabs := hub.tabList()
+			for _, tab := range tabs {
+				tab.Content = eolContent(tab.Content)
+			}
+			replaced, err := hub.storage.CreateSnapshot(req.Name, req.Description, tabs, *snapshotMax, req.Overwrite)
+			if err != nil {
+				var tooLarge *SnapshotTooLargeError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, "Snapshot too large: "+tooLarge.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+				return
+			}
+
+			if replaced {
+				w.WriteHeader(http.StatusOK)
 			} else {
-				http.Error(w, "Invalid password", http.StatusUnauthorized)
-				log.Println("Authentication failed: invalid password")
+				w.WriteHeader(http.StatusCreated)
+			}
+		} else if r.Method == "GET" {
+			snapshots, err := hub.storage.GetSnapshots(50)
+			if err != nil {
+				http.Error(w, "Failed to get snapshots", http.StatusInternalServerError)
+				return
 			}
+
+			json.NewEncoder(w).Encode(snapshots)
 		} else if r.Method == "DELETE" {
-			// Logout
-			cookie, err := r.Cookie("session_id")
-			if err == nil {
-				deleteSession(cookie.Value)
+			var req struct {
+				ID int `json:"id"`
 			}
-			
-			http.SetCookie(w, &http.Cookie{
-				Name:   "session_id",
-				Value:  "",
-				Path:   "/",
-				MaxAge: -1,
-			})
-			
-			json.NewEncoder(w).Encode(map[string]string{
-				"status": "logged_out",
-			})
-			log.Println("User logged out")
-		} else if r.Method == "GET" {
-			// Check session
-			cookie, err := r.Cookie("session_id")
-			if err != nil || !validateSession(cookie.Value) {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+
+			if err := hub.storage.DeleteSnapshot(req.ID); err != nil {
+				http.Error(w, "Failed to delete snapshot", http.StatusInternalServerError)
 				return
 			}
-			
-			json.NewEncoder(w).Encode(map[string]string{
-				"status": "authenticated",
-			})
+
+			w.WriteHeader(http.StatusOK)
 		}
 	}
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_id")
-		if err != nil || !validateSession(cookie.Value) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+// snapshotRoom enforces --max-snapshots before a snapshot is created,
+// either rejecting the request or pruning the oldest snapshots to make
+// room. Overwriting an existing snapshot never counts against the limit.
+// It reports whether the snapshot may be created, having written an error
+// response otherwise.
+func snapshotRoom(hub *Hub, w http.ResponseWriter, r *http.Request, name string, overwrite bool) bool {
+	if overwrite {
+		exists, err := hub.storage.SnapshotNameExists(name)
+		if err != nil {
+			http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+			return false
+		}
+		if exists {
+			return true
 		}
-
-		next(w, r)
 	}
-}
 
-func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	// Verify session from cookie
-	cookie, err := r.Cookie("session_id")
-	if err != nil || !validateSession(cookie.Value) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+	n, err := hub.storage.CountSnapshots()
+	if err != nil {
+		http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+		return false
+	}
+	if n < *maxSnapshots {
+		return true
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if *snapshotFull != "prune" {
+		http.Error(w, fmt.Sprintf("Snapshot limit reached (%d); delete one first", *maxSnapshots), http.StatusConflict)
+		return false
+	}
+	pruned, err := hub.storage.PruneSnapshots(*maxSnapshots - 1)
 	if err != nil {
-		log.Println(err)
-		return
+		http.Error(w, "Failed to prune snapshots", http.StatusInternalServerError)
+		return false
 	}
+	log.Printf("[%s] Pruned %d oldest snapshots to stay within --max-snapshots=%d", requestID(r), pruned, *maxSnapshots)
+	return true
+}
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+// snapshotTabDiff describes how one tab differs between two snapshots.
+// Status is "added" (only in b), "removed" (only in a) or "changed"; Diff
+// is a unified diff of the content from a to b.
+type snapshotTabDiff struct {
+	TabID   string `json:"tabId"`
+	Status  string `json:"status"`
+	Name    string `json:"name"`
+	OldName string `json:"oldName,omitempty"`
+	Diff    string `json:"diff,omitempty"`
+}
 
-	go client.writePump()
-	go client.readPump()
+// handleSnapshotDiff serves GET /api/snapshots/diff?a=ID&b=ID, comparing
+// the tabs of two snapshots by tab ID. Unchanged tabs are omitted.
+func handleSnapshotDiff(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var tabs [2][]*Tab
+		for i, param := range []string{"a", "b"} {
+			id, err := strconv.Atoi(r.URL.Query().Get(param))
+			if err != nil {
+				http.Error(w, "Invalid snapshot ID "+param, http.StatusBadRequest)
+				return
+			}
+			snapshot, err := hub.storage.GetSnapshot(id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Snapshot %d not found", id), http.StatusNotFound)
+				return
+			}
+			if err := json.Unmarshal([]byte(snapshot.TabsData), &tabs[i]); err != nil {
+				http.Error(w, "Failed to decode snapshot", http.StatusInternalServerError)
+				return
+			}
+			// Snapshots taken before --normalize-line-endings was set
+			// would otherwise differ from later ones on every line.
+			for _, tab := range tabs[i] {
+				tab.Content = eolContent(tab.Content)
+			}
+		}
+
+		before := make(map[string]*Tab, len(tabs[0]))
+		for _, tab := range tabs[0] {
+			before[tab.ID] = tab
+		}
+
+		diffs := []snapshotTabDiff{}
+		for _, tab := range tabs[1] {
+			old, exists := before[tab.ID]
+			delete(before, tab.ID)
+			switch {
+			case !exists:
+				diffs = append(diffs, snapshotTabDiff{TabID: tab.ID, Status: "added", Name: tab.Name, Diff: unifiedDiff("", tab.Content)})
+			case old.Name != tab.Name || old.Content != tab.Content:
+				d := snapshotTabDiff{TabID: tab.ID, Status: "changed", Name: tab.Name, Diff: unifiedDiff(old.Content, tab.Content)}
+				if old.Name != tab.Name {
+					d.OldName = old.Name
+				}
+				diffs = append(diffs, d)
+			}
+		}
+		for _, tab := range tabs[0] {
+			if _, removed := before[tab.ID]; removed {
+				diffs = append(diffs, snapshotTabDiff{TabID: tab.ID, Status: "removed", Name: tab.Name, Diff: unifiedDiff(tab.Content, "")})
+			}
+		}
+
+		json.NewEncoder(w).Encode(diffs)
+	}
 }
 
-func handleHistory(hub *Hub) http.HandlerFunc {
+// Page sizes for GET /api/snapshots/<id>/tabs.
+const (
+	snapshotTabsLimit    = 20
+	snapshotTabsMaxLimit = 100
+)
+
+// handleSnapshotTabs serves GET /api/snapshots/<id>/tabs?limit=N&offset=N,
+// one page of a snapshot's tabs, so a large snapshot can be browsed without
+// downloading it whole.
+func handleSnapshotTabs(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tabID := r.URL.Query().Get("tabId")
-		if tabID == "" {
-			http.Error(w, "Missing tabId", http.StatusBadRequest)
+		idText, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/snapshots/"), "/")
+		id, err := strconv.Atoi(idText)
+		if err != nil || resource != "tabs" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		limit := 20
-		history, err := hub.storage.GetHistory(tabID, limit)
+		limit, offset := snapshotTabsLimit, 0
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			if limit > snapshotTabsMaxLimit {
+				limit = snapshotTabsMaxLimit
+			}
+		}
+		if v := r.URL.Query().Get("offset"); v != "" {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+
+		snapshot, err := hub.storage.GetSnapshot(id)
 		if err != nil {
-			http.Error(w, "Failed to get history", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Snapshot %d not found", id), http.StatusNotFound)
+			return
+		}
+		var tabs []*Tab
+		if err := json.Unmarshal([]byte(snapshot.TabsData), &tabs); err != nil {
+			http.Error(w, "Failed to decode snapshot", http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(history)
+		page := []*Tab{}
+		if offset < len(tabs) {
+			page = tabs[offset:min(offset+limit, len(tabs))]
+		}
+		for _, tab := range page {
+			tab.countText()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"snapshotId": snapshot.ID,
+			"total":      len(tabs),
+			"offset":     offset,
+			"limit":      limit,
+			"tabs":       page,
+		})
 	}
 }
 
-func handleSnapshot(hub *Hub) http.HandlerFunc {
+func handleTemplates(hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" {
 			var req struct {
-				Name        string `json:"name"`
-				Description string `json:"description"`
+				Name    string `json:"name"`
+				Content string `json:"content"`
 			}
 
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 				http.Error(w, "Invalid request", http.StatusBadRequest)
 				return
 			}
-
-			hub.mu.RLock()
-			tabs := make([]*Tab, 0, len(hub.tabs))
-			for _, tab := range hub.tabs {
-				tabs = append(tabs, tab)
+			name, err := cleanName(req.Name)
+			if err != nil {
+				http.Error(w, "Invalid name: "+err.Error(), http.StatusBadRequest)
+				return
 			}
-			hub.mu.RUnlock()
+			req.Name = name
 
-			if err := hub.storage.CreateSnapshot(req.Name, req.Description, tabs); err != nil {
-				http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
+			if err := hub.storage.SaveTemplate(req.Name, req.Content); err != nil {
+				http.Error(w, "Failed to save template", http.StatusInternalServerError)
 				return
 			}
 
 			w.WriteHeader(http.StatusCreated)
 		} else if r.Method == "GET" {
-			snapshots, err := hub.storage.GetSnapshots(50)
+			templates, err := hub.storage.GetTemplates()
 			if err != nil {
-				http.Error(w, "Failed to get snapshots", http.StatusInternalServerError)
+				http.Error(w, "Failed to get templates", http.StatusInternalServerError)
 				return
 			}
 
-			json.NewEncoder(w).Encode(snapshots)
+			json.NewEncoder(w).Encode(templates)
 		} else if r.Method == "DELETE" {
 			var req struct {
-				ID int `json:"id"`
+				Name string `json:"name"`
 			}
 
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -477,8 +3554,8 @@ func handleSnapshot(hub *Hub) http.HandlerFunc {
 				return
 			}
 
-			if err := hub.storage.DeleteSnapshot(req.ID); err != nil {
-				http.Error(w, "Failed to delete snapshot", http.StatusInternalServerError)
+			if err := hub.storage.DeleteTemplate(req.Name); err != nil {
+				http.Error(w, "Failed to delete template", http.StatusInternalServerError)
 				return
 			}
 
@@ -493,11 +3570,23 @@ func handleImageUpload(hub *Hub) http.HandlerFunc {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if shedLoad(hub, w, r) {
+			return
+		}
 
-		if err := r.ParseMultipartForm(10 << 20); err != nil { // 10MB max
-			http.Error(w, "File too large", http.StatusBadRequest)
+		// Allow some slack over the file limit for the multipart framing;
+		// parts beyond the memory threshold spill to temporary files.
+		r.Body = http.MaxBytesReader(w, r.Body, *uploadLimit+1<<20)
+		if err := r.ParseMultipartForm(*uploadMemory); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Invalid upload", http.StatusBadRequest)
+			}
 			return
 		}
+		defer r.MultipartForm.RemoveAll()
 
 		file, header, err := r.FormFile("image")
 		if err != nil {
@@ -506,30 +3595,174 @@ func handleImageUpload(hub *Hub) http.HandlerFunc {
 		}
 		defer file.Close()
 
-		data, err := io.ReadAll(file)
+		data, err := io.ReadAll(io.LimitReader(file, *uploadLimit+1))
 		if err != nil {
 			http.Error(w, "Failed to read file data", http.StatusInternalServerError)
 			return
 		}
+		if int64(len(data)) > *uploadLimit {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		saveUpload(hub, w, r, sanitizeFilename(header.Filename), data)
+	}
+}
+
+// saveUpload stores uploaded image data, downscaled and re-encoded as
+// configured, under a new ID and replies with the ID and URL. The type is
+// taken from the data, not the client, and must be in
+// --allowed-image-types; SVGs are sanitized, and raster images over
+// maxImagePixels are refused.
+func saveUpload(hub *Hub, w http.ResponseWriter, r *http.Request, filename string, data []byte) {
+	mimeType := sniffImageType(data)
+	if !allowedTypes[mimeType] {
+		http.Error(w, fmt.Sprintf("Image type %s is not allowed", mimeType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if mimeType == svgMimeType {
+		clean, err := sanitizeSVG(data)
+		if err != nil {
+			http.Error(w, "Invalid SVG: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		data = clean
+	} else if err := checkImagePixels(data); err != nil {
+		http.Error(w, "Image too large: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if *maxImageDim > 0 {
+		if resized, format, ok := downscaleImage(data, *maxImageDim); ok {
+			data = resized
+			mimeType = "image/" + format
+		}
+	}
+	if *imageFormat != "" {
+		if converted, ok := convertImage(data, *imageFormat); ok {
+			data = converted
+			mimeType = "image/" + *imageFormat
+			filename = withExtension(filename, *imageFormat)
+		}
+	}
+
+	img := &ImageRecord{
+		Filename: filename,
+		Data:     data,
+		MimeType: mimeType,
+		Size:     int64(len(data)),
+	}
+
+	var err error
+	for attempt := 0; attempt < maxImageIDAttempts; attempt++ {
+		img.ID = newImageID()
+		if err = hub.images.SaveImage(img); !errors.Is(err, errImageIDTaken) {
+			break
+		}
+	}
+	imageID := img.ID
+	if errors.Is(err, errImageIDTaken) {
+		log.Printf("[%s] Failed to save image: no unique ID after %d attempts", requestID(r), maxImageIDAttempts)
+		http.Error(w, "Could not allocate a unique image ID", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to save image %s: %v", requestID(r), imageID, err)
+		http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"imageId":  imageID,
+		"imageUrl": imageURL(imageID),
+	})
+}
+
+// newImageID returns a random image ID. IDs are long enough that pruning
+// can find references to them in tab content by substring.
+func newImageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sanitizeFilename reduces a client-supplied filename to a safe base name:
+// directory components, control characters (including CR/LF) and quoting
+// characters are removed so the name cannot inject into response headers.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`"';`, r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "image"
+	}
+	return name
+}
+
+// imageURL returns the public URL for an image. /api/images/<id> always
+// serves as the origin, so a CDN configured via --image-base-url can pull
+// from it.
+func imageURL(imageID string) string {
+	if *imageBaseURL != "" {
+		return strings.TrimRight(*imageBaseURL, "/") + "/" + imageID
+	}
+	return fmt.Sprintf("/api/images/%s", imageID)
+}
+
+func handleImageList(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		images, err := hub.storage.GetImages(100)
+		if err != nil {
+			http.Error(w, "Failed to get images", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(images)
+	}
+}
 
-		imageID := fmt.Sprintf("%d", time.Now().UnixNano())
-		img := &ImageRecord{
-			ID:       imageID,
-			Filename: header.Filename,
-			Data:     data,
-			MimeType: header.Header.Get("Content-Type"),
-			Size:     header.Size,
+// handleImagePrune serves DELETE /api/images?before=<time>, removing images
+// older than the given time that no tab, history entry or snapshot still
+// refers to.
+func handleImagePrune(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		before, err := parseBefore(r)
+		if err != nil {
+			http.Error(w, "Invalid or missing before", http.StatusBadRequest)
+			return
 		}
 
-		if err := hub.storage.SaveImage(img); err != nil {
-			http.Error(w, "Failed to save image", http.StatusInternalServerError)
+		ids, err := hub.storage.UnreferencedImagesBefore(before)
+		if err != nil {
+			http.Error(w, "Failed to list images", http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(map[string]string{
-			"imageId":  imageID,
-			"imageUrl": fmt.Sprintf("/api/images/%s", imageID),
-		})
+		deleted := 0
+		for _, id := range ids {
+			if err := hub.images.DeleteImage(id); err != nil {
+				log.Printf("[%s] Failed to delete image %s: %v", requestID(r), id, err)
+				continue
+			}
+			deleted++
+		}
+
+		log.Printf("[%s] Deleted %d images before %s", requestID(r), deleted, before.Format(time.RFC3339))
+		json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
 	}
 }
 
@@ -541,19 +3774,106 @@ func handleImageGet(hub *Hub) http.HandlerFunc {
 			return
 		}
 
-		img, err := hub.storage.GetImage(imageID)
+		if r.Method == "PATCH" {
+			handleImagePatch(hub, imageID, w, r)
+			return
+		}
+
+		// Image bytes never change for an ID, so conditional requests are
+		// answered from the metadata without opening the image.
+		meta, err := hub.storage.GetImageMeta(imageID)
+		if err != nil {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		etag := meta.Hash
+		if etag == "" {
+			etag = meta.ID
+		}
+		etag = `"` + etag + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+		if *imageMaxAge > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d, immutable", int(imageMaxAge.Seconds())))
+		}
+		if notModified(r, etag, meta.Created) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		img, body, err := hub.images.OpenImage(imageID)
 		if err != nil {
 			http.Error(w, "Image not found", http.StatusNotFound)
 			return
 		}
+		defer body.Close()
 
 		w.Header().Set("Content-Type", img.MimeType)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", img.Filename))
-		w.Write(img.Data)
+		if img.MimeType == svgMimeType {
+			// Opened directly, an SVG is a document; keep it from
+			// running script or loading anything.
+			w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+			"filename": sanitizeFilename(img.Filename),
+		}))
+		io.Copy(w, body)
+	}
+}
+
+// notModified evaluates If-None-Match, or failing that If-Modified-Since,
+// against a resource's ETag and modification time.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !modified.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+func handleImagePatch(hub *Hub, imageID string, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Filename *string `json:"filename"`
+		Alt      *string `json:"alt"`
 	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	img, err := hub.storage.GetImage(imageID)
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if req.Filename != nil && *req.Filename != "" {
+		img.Filename = sanitizeFilename(*req.Filename)
+	}
+	if req.Alt != nil {
+		img.Alt = *req.Alt
+	}
+
+	if err := hub.storage.UpdateImageMeta(imageID, img.Filename, img.Alt); err != nil {
+		http.Error(w, "Failed to update image", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(img)
 }
 
 func main() {
+	if runSubcommand(os.Args[1:]) {
+		return
+	}
 	flag.Parse()
 
 	// Get password from secure source
@@ -562,32 +3882,156 @@ func main() {
 	// Start session cleanup
 	cleanupSessions()
 
-	// Create data directory
-	if err := os.MkdirAll(*dataDir, 0755); err != nil {
-		log.Fatal("Failed to create data directory:", err)
+	nets, err := parseTrustedProxies(*trustedProxy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedNets = nets
+
+	allowedTypes = parseImageTypes(*imageTypes)
+
+	perms, err := parseOriginPermissions(*originPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	originPerms = perms
+
+	if *sendBuf < 1 {
+		log.Fatalf("Invalid --send-buffer %d: must be at least 1", *sendBuf)
+	}
+
+	if *initMode != "full" && *initMode != "metadata" {
+		log.Fatalf("Invalid --init-mode %q: want full or metadata", *initMode)
+	}
+	if *storageMode != "sqlite" && *storageMode != "memory" {
+		log.Fatalf("Invalid --storage %q: want sqlite or memory", *storageMode)
+	}
+
+	if *connectRate > 0 {
+		connectLimiter = newRateLimiter(*connectRate, time.Minute)
+	}
+
+	if err := registerBuiltinTransforms(); err != nil {
+		log.Fatal(err)
 	}
 
 	// Initialize storage
-	storage, err := NewStorage(*dataDir)
+	var storage *Storage
+	if *storageMode == "memory" {
+		log.Printf("Using in-memory storage; nothing is kept after exit")
+		storage, err = NewMemoryStorage(sqlitePragmas()...)
+	} else {
+		if err := os.MkdirAll(*dataDir, 0755); err != nil {
+			log.Fatal("Failed to create data directory:", err)
+		}
+		storage, err = NewStorage(*dataDir, sqlitePragmas()...)
+		var corrupt *corruptionError
+		if errors.As(err, &corrupt) {
+			if !*recoverDB {
+				log.Fatalf("Failed to initialize storage: %v\nRestore a backup, or start with --recover-db to move the file aside and copy what can be read into a new database", err)
+			}
+			log.Printf("%v; attempting recovery", err)
+			storage, err = RecoverStorage(*dataDir, sqlitePragmas()...)
+		}
+	}
 	if err != nil {
 		log.Fatal("Failed to initialize storage:", err)
 	}
 	defer storage.Close()
 
-	hub := newHub(storage)
+	key, err := encryptionKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	storage.encryptAll = *encScope != "tabs"
+	storage.historyDiffs = *historyDiffs
+	if err := storage.setEncryptionKey(key); err != nil {
+		log.Fatal(err)
+	}
+	if key != nil {
+		log.Printf("Encrypting content and images at rest")
+	}
+
+	images, err := newImageStore(storage)
+	if err != nil {
+		log.Fatal("Failed to initialize image store:", err)
+	}
+
+	newTabContent = getNewTabContent()
+	hub := newHub(storage, images)
+	storage.onWriteHealth = hub.storageHealthChanged
+	if *seedDir != "" {
+		if *upstreamURL != "" {
+			log.Printf("Ignoring --seed-dir: read replicas mirror the primary's tabs")
+		} else if err := hub.seedTabs(*seedDir, *seedOver); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *webhookURLs != "" {
+		hub.webhooks = newWebhookNotifier(splitList(*webhookURLs), webhookSecret(), 256)
+	}
 	go hub.run()
+	if *upstreamURL != "" {
+		// Expiry is decided by the primary and arrives as delete or
+		// update messages.
+		go follow(hub, *upstreamURL, upstreamPassword())
+	} else {
+		go hub.expireTabs(30 * time.Second)
+	}
+	if *saveInterval > 0 {
+		go hub.flushLoop(*saveInterval)
+	}
+	if *idleTimeout > 0 {
+		go hub.disconnectIdle(*idleTimeout)
+	}
+	go hub.disconnectExpired()
+	chunkedUploads = newUploadTracker(*uploadTTL)
+	go chunkedUploads.expire(time.Minute)
+	if *presenceTick > 0 {
+		go hub.broadcastPresence(*presenceTick)
+	}
 
 	// Start auto-save goroutine
 	go storage.AutoSaveHistory(hub)
+	if *historyDelay > 0 {
+		go storage.DebounceHistory(hub, *historyDelay)
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/auth", handleAuth(pwd))
+	mux.HandleFunc("/api/version", handleVersion)
+	mux.HandleFunc("/api/branding", handleBranding)
+	mux.HandleFunc("/api/openapi.json", handleOpenAPI)
+	if *brandingDir != "" {
+		mux.Handle("/branding/", http.StripPrefix("/branding/", http.FileServer(http.Dir(*brandingDir))))
+	}
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz(hub, storage))
 	mux.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(hub, w, r)
 	})
-	mux.HandleFunc("/api/history", authMiddleware(handleHistory(hub)))
+	if apiKey := getAPIKey(); apiKey != "" {
+		mux.HandleFunc("/api/ingest", handleIngest(hub, apiKey))
+	}
+	adminToken := getAdminToken()
+	mux.HandleFunc("/api/clients", operatorMiddleware(adminToken, handleClients(hub)))
+	mux.HandleFunc("/api/reset", operatorMiddleware(adminToken, handleReset(hub)))
+	mux.HandleFunc("/api/announce", operatorMiddleware(adminToken, handleAnnounce(hub)))
+	mux.HandleFunc("/api/maintenance", operatorMiddleware(adminToken, handleMaintenance(hub)))
+	mux.HandleFunc("/api/clients/", operatorMiddleware(adminToken, handleClients(hub)))
+	mux.HandleFunc("/api/events", authMiddleware(handleEvents(hub)))
+	mux.HandleFunc("/api/stats", authMiddleware(handleStats(hub)))
+	mux.HandleFunc("/api/tabs", authMiddleware(handleTabs(hub)))
+	mux.HandleFunc("/api/tabs/", authMiddleware(handleTab(hub)))
+	mux.HandleFunc("/api/history", operatorDelete(adminToken, handleHistoryPrune(hub), handleHistory(hub)))
+	mux.HandleFunc("/api/history/timeline", authMiddleware(handleHistoryTimeline(hub)))
 	mux.HandleFunc("/api/snapshots", authMiddleware(handleSnapshot(hub)))
+	mux.HandleFunc("/api/snapshots/diff", authMiddleware(handleSnapshotDiff(hub)))
+	mux.HandleFunc("/api/snapshots/", authMiddleware(handleSnapshotTabs(hub)))
+	mux.HandleFunc("/api/templates", authMiddleware(handleTemplates(hub)))
 	mux.HandleFunc("/api/upload", authMiddleware(handleImageUpload(hub)))
+	mux.HandleFunc("/api/upload/", authMiddleware(handleChunkedUpload(hub)))
+	mux.HandleFunc("/api/images", operatorDelete(adminToken, handleImagePrune(hub), handleImageList(hub)))
 	mux.HandleFunc("/api/images/", authMiddleware(handleImageGet(hub)))
 
 	// Serve static files
@@ -596,14 +4040,54 @@ func main() {
 
 	handler := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
-	}).Handler(mux)
+		ExposedHeaders:   []string{"X-Request-ID"},
+		MaxAge:           int(corsMaxAge.Seconds()),
+	}).Handler(requestIDMiddleware(bodyLimitMiddleware(maintenanceMiddleware(hub, mux))))
+	if *upstreamURL != "" {
+		handler = followerMiddleware(handler)
+	}
 
 	addr := fmt.Sprintf(":%s", *port)
+	info := buildInfo()
+	log.Printf("BoardCast %s (commit %s, built %s)", info["version"], info["commit"], info["buildDate"])
 	log.Printf("BoardCast server starting on http://localhost:%s", *port)
-	log.Printf("Data directory: %s", *dataDir)
+	if *storageMode != "memory" {
+		log.Printf("Data directory: %s", *dataDir)
+	}
 	log.Printf("Password configured: %s", "Yes")
-	log.Fatal(http.ListenAndServe(addr, handler))
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	server.RegisterOnShutdown(hub.closeStreams)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// SIGHUP persists everything without stopping, e.g. before a
+	// filesystem-level backup of the data directory.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			flushed, versioned := hub.checkpoint()
+			log.Printf("SIGHUP: flushed %d pending tab(s), saved history for %d tab(s)", flushed, versioned)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	hub.closeAll()
+	log.Printf("Flushed %d pending tab(s)", hub.flush())
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHub returns a hub on a fresh database. Its run loop isn't
+// started.
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	s := newTestStorage(t)
+	images, err := newImageStore(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHub(s, images)
+}
+
+// connectTestClient starts hub's run loop and connects a client to it,
+// returning the client once it has had init.
+func connectTestClient(t *testing.T, hub *Hub) *Client {
+	t.Helper()
+	go hub.run()
+	client := &Client{id: "test", hub: hub, send: make(chan []byte, 64), subscribed: make(map[string]bool)}
+	hub.register <- client
+	if msg := receive(t, client); msg.Type != "init" {
+		t.Fatalf("got %s, want init", msg.Type)
+	}
+	return client
+}
+
+// send hands msg to the hub as if client sent it and returns the next
+// message the client gets back, skipping presence updates.
+func send(t *testing.T, client *Client, msg Message) Message {
+	t.Helper()
+	data, _ := json.Marshal(msg)
+	client.hub.enqueueFrom(client, data)
+	return receive(t, client)
+}
+
+func receive(t *testing.T, client *Client) Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case data := <-client.send:
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != "presence" {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("no message from the hub")
+		}
+	}
+}
+
+var filenameTests = []struct {
+	name, in, want string
+}{
+	{"plain", "photo.png", "photo.png"},
+	{"CRLF header injection", "a.png\r\nSet-Cookie: session_id=x", "a.pngSet-Cookie: session_id=x"},
+	{"bare LF", "a\nb.png", "ab.png"},
+	{"other control characters", "a\x00\tb\x7f.png", "ab.png"},
+	{"double quotes", `evil".png`, "evil.png"},
+	{"single quote and semicolon", "a';b.png", "ab.png"},
+	{"unix path", "../../etc/passwd", "passwd"},
+	{"windows path", `C:\Users\me\photo.png`, "photo.png"},
+	{"mixed separators", `a/b\c.png`, "c.png"},
+	{"trailing separator", "dir/", "image"},
+	{"dot dot", "..", "image"},
+	{"only unsafe characters", "\r\n\";", "image"},
+	{"surrounding space", "  photo.png  ", "photo.png"},
+	{"unicode", "фото.png", "фото.png"},
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for _, tt := range filenameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestImageContentDisposition checks the header sent for images stored
+// with a hostile filename, e.g. by a version that didn't sanitize uploads.
+func TestImageContentDisposition(t *testing.T) {
+	hub := newTestHub(t)
+	for _, tt := range filenameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := &ImageRecord{ID: newImageID(), Filename: tt.in, Data: []byte("data"), MimeType: "image/png", Size: 4}
+			if err := hub.images.SaveImage(img); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			handleImageGet(hub)(w, httptest.NewRequest("GET", "/api/images/"+img.ID, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			header := w.Header().Get("Content-Disposition")
+			if strings.ContainsAny(header, "\r\n") {
+				t.Fatalf("Content-Disposition %q contains a line break", header)
+			}
+			disposition, params, err := mime.ParseMediaType(header)
+			if err != nil {
+				t.Fatalf("Content-Disposition %q doesn't parse: %v", header, err)
+			}
+			if disposition != "inline" || len(params) != 1 || params["filename"] != tt.want {
+				t.Errorf("Content-Disposition %q parses as %s %v, want inline with filename %q", header, disposition, params, tt.want)
+			}
+		})
+	}
+}
+
+func TestTabNameConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		msg      Message
+		wantName string // empty when the message is rejected
+	}{
+		{"create new name", "reject", Message{Type: "create", Name: "Todo"}, "Todo"},
+		{"create differing in case", "reject", Message{Type: "create", Name: "NOTES"}, ""},
+		{"create same name", "reject", Message{Type: "create", Name: "Notes"}, ""},
+		{"rename to another tab's name", "reject", Message{Type: "rename", TabID: "default", Name: "notes"}, ""},
+		{"rename changing own case", "reject", Message{Type: "rename", TabID: "notes", Name: "NOTES"}, "NOTES"},
+		{"create with suffix", "suffix", Message{Type: "create", Name: "notes"}, "notes (3)"},
+		{"create suffixed name differing in case", "suffix", Message{Type: "create", Name: "NOTES (2)"}, "NOTES (2) (2)"},
+		{"rename with suffix", "suffix", Message{Type: "rename", TabID: "default", Name: "NOTES"}, "NOTES (3)"},
+		{"rename changing own case with suffix", "suffix", Message{Type: "rename", TabID: "notes", Name: "nOtEs"}, "nOtEs"},
+	}
+	defer func(policy string) { *nameConflict = policy }(*nameConflict)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*nameConflict = tt.policy
+			hub := newTestHub(t)
+			client := connectTestClient(t, hub)
+			if reply := send(t, client, Message{Type: "create", TabID: "notes", Name: "Notes"}); reply.Name != "Notes" {
+				t.Fatalf("setup: create Notes got %+v", reply)
+			}
+			if tt.policy == "suffix" {
+				if reply := send(t, client, Message{Type: "create", TabID: "notes-2", Name: "Notes"}); reply.Name != "Notes (2)" {
+					t.Fatalf("setup: second create Notes got %+v", reply)
+				}
+			}
+
+			reply := send(t, client, tt.msg)
+			if tt.wantName == "" {
+				if reply.Type != "error" {
+					t.Fatalf("got %s %q, want an error", reply.Type, reply.Name)
+				}
+				return
+			}
+			if reply.Type != tt.msg.Type || reply.Name != tt.wantName {
+				t.Fatalf("got %s %q (%s), want %s %q", reply.Type, reply.Name, reply.Error, tt.msg.Type, tt.wantName)
+			}
+			hub.mu.RLock()
+			defer hub.mu.RUnlock()
+			if tab := hub.tabs[reply.TabID]; tab == nil || tab.Name != tt.wantName {
+				t.Errorf("tab %s is %+v, want it named %q", reply.TabID, tab, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestTabSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want string // the type of the first message back
+	}{
+		{"language", Message{Type: "set-language", TabID: "default", Language: "go"}, "set-language"},
+		{"clear language", Message{Type: "set-language", TabID: "default"}, "set-language"},
+		{"unknown language", Message{Type: "set-language", TabID: "default", Language: "klingon"}, "error"},
+		{"language of missing tab", Message{Type: "set-language", TabID: "missing", Language: "go"}, "pong"},
+		{"render mode", Message{Type: "set-render-mode", TabID: "default", RenderMode: "code"}, "set-render-mode"},
+		{"clear render mode", Message{Type: "set-render-mode", TabID: "default"}, "set-render-mode"},
+		{"unknown render mode", Message{Type: "set-render-mode", TabID: "default", RenderMode: "hologram"}, "error"},
+		{"render mode of missing tab", Message{Type: "set-render-mode", TabID: "missing", RenderMode: "code"}, "pong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := newTestHub(t)
+			client := connectTestClient(t, hub)
+			data, _ := json.Marshal(tt.msg)
+			hub.enqueueFrom(client, data)
+			// The hub handles messages in order, so pong comes first only
+			// when nothing was sent for msg.
+			if reply := send(t, client, Message{Type: "ping"}); reply.Type != tt.want {
+				t.Fatalf("got %s (%s), want %s", reply.Type, reply.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovedTabsLeaveNoState(t *testing.T) {
+	for _, op := range []string{"archive", "expire"} {
+		t.Run(op, func(t *testing.T) {
+			defer func(action string) { *expiryAction = action }(*expiryAction)
+			*expiryAction = "delete"
+			hub := newTestHub(t)
+			client := connectTestClient(t, hub)
+			send(t, client, Message{Type: "create", TabID: "notes", Name: "Notes"})
+			send(t, client, Message{Type: "update", TabID: "notes", Content: "hello"})
+			send(t, client, Message{Type: "claim", TabID: "notes"})
+			client.hub.enqueueFrom(client, []byte(`{"type":"subscribe","tabId":"notes"}`))
+
+			if op == "expire" {
+				past := time.Now().Add(-time.Minute)
+				hub.mu.Lock()
+				hub.tabs["notes"].ExpiresAt = &past
+				hub.mu.Unlock()
+				data, _ := json.Marshal(Message{Type: "expire", TabID: "notes"})
+				hub.enqueue(data)
+			} else {
+				client.hub.enqueueFrom(client, []byte(`{"type":"archive","tabId":"notes"}`))
+			}
+			// The hub handles messages in order, so once ping is answered
+			// the tab is gone.
+			for reply := send(t, client, Message{Type: "ping"}); reply.Type != "pong"; reply = receive(t, client) {
+			}
+
+			hub.mu.RLock()
+			defer hub.mu.RUnlock()
+			if _, ok := hub.tabs["notes"]; ok {
+				t.Fatal("tab is still active")
+			}
+			if _, ok := hub.versions["notes"]; ok {
+				t.Error("version was kept")
+			}
+			if _, ok := hub.claims["notes"]; ok {
+				t.Error("claim was kept")
+			}
+			hub.clientsMu.RLock()
+			defer hub.clientsMu.RUnlock()
+			if len(hub.viewers["notes"]) > 0 || client.subscribed["notes"] {
+				t.Error("viewers were kept")
+			}
+		})
+	}
+}
+
+func TestExpiryClearIsVersioned(t *testing.T) {
+	defer func(action string) { *expiryAction = action }(*expiryAction)
+	*expiryAction = "clear"
+	hub := newTestHub(t)
+	client := connectTestClient(t, hub)
+	before := send(t, client, Message{Type: "update", TabID: "default", Content: "hello world"})
+
+	past := time.Now().Add(-time.Minute)
+	hub.mu.Lock()
+	hub.tabs["default"].ExpiresAt = &past
+	hub.mu.Unlock()
+	data, _ := json.Marshal(Message{Type: "expire", TabID: "default"})
+	hub.enqueue(data)
+
+	msg := receive(t, client)
+	if msg.Type != "update" || msg.Content != "" || msg.Version != before.Version+1 {
+		t.Fatalf("got %s %q version %d, want an empty update version %d", msg.Type, msg.Content, msg.Version, before.Version+1)
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if v := hub.versions["default"]; v != msg.Version {
+		t.Errorf("hub is at version %d, sent %d", v, msg.Version)
+	}
+}
+
+func TestDropUpdatesKeepsNewest(t *testing.T) {
+	defer func(size int, drop bool) { *broadcastBuf, *dropUpdates = size, drop }(*broadcastBuf, *dropUpdates)
+	*broadcastBuf, *dropUpdates = 2, true
+	hub := newTestHub(t)
+	client := connectTestClient(t, hub)
+	writer := &Client{id: "writer", hub: hub, send: make(chan []byte, 64), subscribed: make(map[string]bool)}
+
+	// Stall the hub so the updates back up behind it.
+	hub.mu.Lock()
+	const edits = 20
+	for i := 1; i <= edits; i++ {
+		data, _ := json.Marshal(Message{Type: "update", TabID: "default", Content: fmt.Sprintf("edit %d", i)})
+		hub.enqueueFrom(writer, data)
+	}
+	hub.mu.Unlock()
+
+	want := fmt.Sprintf("edit %d", edits)
+	for msg := receive(t, client); msg.Content != want; msg = receive(t, client) {
+	}
+	if hub.dropped.Load() == 0 {
+		t.Error("no updates were dropped")
+	}
+	for reply := send(t, client, Message{Type: "ping"}); reply.Type != "pong"; reply = receive(t, client) {
+		if reply.Type == "update" {
+			t.Errorf("got %q after the newest update", reply.Content)
+		}
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if got := hub.tabs["default"].Content; got != want {
+		t.Errorf("tab content is %q, want %q", got, want)
+	}
+}
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	hub := newTestHub(t)
+	go hub.run()
+	server := httptest.NewUnstartedServer(handleEvents(hub))
+	server.Config.RegisterOnShutdown(hub.closeStreams)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || !strings.Contains(line, `"type":"init"`) {
+		t.Fatalf("first line %q (%v), want init", line, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown with an open stream: %v", err)
+	}
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	defer func(limit int64) { *maxBody = limit }(*maxBody)
+	*maxBody = 64
+
+	// decode fails the way most handlers do when the body is cut off.
+	decode := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(v["a"]))
+	})
+	big := `{"a": "` + strings.Repeat("x", 100) + `"}`
+
+	tests := []struct {
+		name, path, body string
+		chunked          bool
+		wantCode         int
+	}{
+		{"small", "/api/ingest", `{"a": "ok"}`, false, http.StatusOK},
+		{"declared too large", "/api/ingest", big, false, http.StatusRequestEntityTooLarge},
+		{"streamed too large", "/api/ingest", big, true, http.StatusRequestEntityTooLarge},
+		{"bad but small", "/api/ingest", `{"a": `, true, http.StatusBadRequest},
+		{"upload", "/api/upload", big, true, http.StatusOK},
+		{"upload chunk", "/api/upload/abc/chunk", big, true, http.StatusOK},
+		{"upload init", "/api/upload/init", big, true, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			bodyLimitMiddleware(decode).ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d (%q), want %d", w.Code, w.Body.String(), tt.wantCode)
+			}
+		})
+	}
+}
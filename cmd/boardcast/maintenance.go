@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maintenanceExempt are the API paths that still accept writes in
+// maintenance mode: logging in and out, and the operator controls needed
+// to announce and end the maintenance or disconnect clients.
+var maintenanceExempt = map[string]bool{
+	"/api/auth":        true,
+	"/api/maintenance": true,
+	"/api/announce":    true,
+}
+
+// setMaintenance turns maintenance mode on or off and tells every client.
+// While it is on the board is read-only: edits over WebSocket are rejected
+// like those from read-only connections, and API requests that change
+// data get 503.
+func (h *Hub) setMaintenance(on bool) {
+	if h.maintenance.Swap(on) == on {
+		return
+	}
+	h.sendAll(Message{Type: "maintenance", Maintenance: on})
+}
+
+// maintenanceMiddleware refuses API requests that could change data while
+// the hub is in maintenance mode. Reads pass, and so do the paths in
+// maintenanceExempt.
+func maintenanceMiddleware(hub *Hub, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hub.maintenance.Load() && r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" &&
+			strings.HasPrefix(r.URL.Path, "/api/") && !maintenanceExempt[r.URL.Path] &&
+			!strings.HasPrefix(r.URL.Path, "/api/clients/") {
+			http.Error(w, "Read-only for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleMaintenance reports maintenance mode on GET and sets it on POST
+// with {"enabled": true|false}. Operator only.
+func handleMaintenance(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+				http.Error(w, `Send {"enabled": true} or {"enabled": false}`, http.StatusBadRequest)
+				return
+			}
+			hub.setMaintenance(*req.Enabled)
+			state := "disabled"
+			if *req.Enabled {
+				state = "enabled"
+			}
+			log.Printf("[%s] Maintenance mode %s", requestID(r), state)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]bool{"maintenance": hub.maintenance.Load()})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migration is one step in upgrading the database schema.
+type migration struct {
+	name  string
+	apply func(tx *sql.Tx) error
+}
+
+// migrations upgrade databases created by older versions, in order, after
+// initSchema has created any missing tables. The number applied is kept
+// in schema_version, and each runs in a transaction with its version bump,
+// so a failed migration leaves the database as it was. Append new
+// migrations; never reorder or change ones that have been released.
+var migrations = []migration{
+	{"add columns from before versioned migrations", addSchemaColumns},
+	{"index history entries by base entry", func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_history_base ON history(base_id) WHERE base_id != 0")
+		return err
+	}},
+}
+
+// migrate applies the migrations the database hasn't had yet. It refuses
+// databases migrated by a newer version, whose schema it doesn't know.
+func (s *Storage) migrate() error {
+	if _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	err := s.db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = s.db.Exec("INSERT INTO schema_version (version) VALUES (0)")
+	}
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d); upgrade boardcast", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		m := migrations[i]
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", i+1, m.name, err)
+		}
+		if _, err := tx.Exec("UPDATE schema_version SET version = ?", i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied schema migration %d: %s", i+1, m.name)
+	}
+	return nil
+}
+
+// schemaColumns lists columns added to the original schema before
+// versioned migrations. Databases from that time may have any subset of
+// them, so the first migration adds whichever are missing.
+var schemaColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"tabs", "archived", "INTEGER NOT NULL DEFAULT 0"},
+	{"tabs", "language", "TEXT NOT NULL DEFAULT ''"},
+	{"images", "alt", "TEXT NOT NULL DEFAULT ''"},
+	{"tabs", "tags", "TEXT NOT NULL DEFAULT '[]'"},
+	{"tabs", "expires_at", "DATETIME"},
+	{"tabs", "render_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"tabs", "pinned", "INTEGER NOT NULL DEFAULT 0"},
+	{"images", "hash", "TEXT NOT NULL DEFAULT ''"},
+	{"tabs", "color", "TEXT NOT NULL DEFAULT ''"},
+	{"tabs", "locales", "TEXT NOT NULL DEFAULT '{}'"},
+	{"tabs", "encrypted", "INTEGER NOT NULL DEFAULT 0"},
+	{"history", "label", "TEXT NOT NULL DEFAULT ''"},
+	{"history", "base_id", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func addSchemaColumns(tx *sql.Tx) error {
+	for _, c := range schemaColumns {
+		if err := addColumn(tx, c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to table unless it already exists.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			ctype   string
+			notNull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
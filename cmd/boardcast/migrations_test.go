@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is the schema of the first releases, before any of
+// schemaColumns were added.
+const baselineSchema = `
+CREATE TABLE tabs (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	content TEXT NOT NULL,
+	updated DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tab_id TEXT NOT NULL,
+	content TEXT NOT NULL,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE snapshots (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	description TEXT,
+	tabs_data TEXT NOT NULL,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE images (
+	id TEXT PRIMARY KEY,
+	filename TEXT NOT NULL,
+	data BLOB NOT NULL,
+	mime_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	created DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO tabs (id, name, content) VALUES ('notes', 'Notes', 'kept across the upgrade');
+INSERT INTO history (tab_id, content) VALUES ('notes', 'an old version');
+`
+
+// createDatabase writes a database with the given SQL in dir.
+func createDatabase(t *testing.T, dir, schema string) {
+	t.Helper()
+	db, err := sql.Open("sqlite", dir+"/boardcast.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatalf("create database: %v", err)
+	}
+}
+
+func tableColumns(t *testing.T, s *Storage, table string) []string {
+	t.Helper()
+	columns, err := s.queryStrings("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return columns
+}
+
+func schemaVersion(t *testing.T, s *Storage) int {
+	t.Helper()
+	var version int
+	if err := s.db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	dir := t.TempDir()
+	createDatabase(t, dir, baselineSchema)
+
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	defer s.Close()
+
+	for _, c := range schemaColumns {
+		if !slices.Contains(tableColumns(t, s, c.table), c.column) {
+			t.Errorf("column %s.%s was not added", c.table, c.column)
+		}
+	}
+	if v := schemaVersion(t, s); v != len(migrations) {
+		t.Errorf("schema_version = %d, want %d", v, len(migrations))
+	}
+
+	tabs, err := s.LoadTabs()
+	if err != nil {
+		t.Fatalf("LoadTabs: %v", err)
+	}
+	if len(tabs) != 1 {
+		t.Fatalf("LoadTabs after migration returned %d tabs, want 1", len(tabs))
+	}
+	if tabs[0].Content != "kept across the upgrade" || tabs[0].Archived {
+		t.Errorf("tab after migration = %+v", *tabs[0])
+	}
+	history, err := s.GetHistory("notes", 10)
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(history) != 1 || history[0].Content != "an old version" {
+		t.Errorf("GetHistory after migration = %+v", history)
+	}
+}
+
+func TestMigratePartialSchema(t *testing.T) {
+	// Some pre-versioning releases had part of schemaColumns already.
+	dir := t.TempDir()
+	createDatabase(t, dir, baselineSchema+`
+ALTER TABLE tabs ADD COLUMN archived INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE tabs ADD COLUMN language TEXT NOT NULL DEFAULT '';
+`)
+
+	s, err := NewStorage(dir)
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	if v := schemaVersion(t, s); v != len(migrations) {
+		t.Errorf("schema_version = %d, want %d", v, len(migrations))
+	}
+	s.Close()
+
+	// Opening a migrated database again applies nothing.
+	s, err = NewStorage(dir)
+	if err != nil {
+		t.Fatalf("NewStorage on a migrated database: %v", err)
+	}
+	defer s.Close()
+	if v := schemaVersion(t, s); v != len(migrations) {
+		t.Errorf("schema_version = %d after reopening, want %d", v, len(migrations))
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	dir := t.TempDir()
+	createDatabase(t, dir, baselineSchema+`
+CREATE TABLE schema_version (version INTEGER NOT NULL);
+INSERT INTO schema_version (version) VALUES (1000);
+`)
+
+	s, err := NewStorage(dir)
+	if err == nil {
+		s.Close()
+		t.Fatal("NewStorage accepted a database from a newer version")
+	}
+	if !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("NewStorage error = %v", err)
+	}
+}
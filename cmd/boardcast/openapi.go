@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the REST API. It is written by hand, so a change to
+// an endpoint's parameters, responses or auth should update it too.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI serves openAPISpec. It needs no session, like /api/version,
+// so API clients can be generated without logging in.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
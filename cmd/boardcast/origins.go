@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// originPerms maps a browser Origin to whether WebSocket connections from it
+// may edit (true) or only watch (false), from --origin-permissions. The key
+// "*" covers origins not listed. Empty means every origin may edit.
+var originPerms map[string]bool
+
+// parseOriginPermissions parses a comma-separated list of origin=read or
+// origin=write entries.
+func parseOriginPermissions(list string) (map[string]bool, error) {
+	perms := make(map[string]bool)
+	for _, entry := range splitList(list) {
+		origin, level, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid origin permission %q: want origin=read or origin=write", entry)
+		}
+		switch level {
+		case "read":
+			perms[normalizeOrigin(origin)] = false
+		case "write":
+			perms[normalizeOrigin(origin)] = true
+		default:
+			return nil, fmt.Errorf("invalid permission %q for origin %s: want read or write", level, origin)
+		}
+	}
+	return perms, nil
+}
+
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// originPermission reports whether a connection from r's Origin may edit,
+// and whether that origin may connect at all. Requests without an Origin
+// header don't come from a browser page and keep full access.
+func originPermission(r *http.Request) (write, allowed bool) {
+	origin := r.Header.Get("Origin")
+	if len(originPerms) == 0 || origin == "" {
+		return true, true
+	}
+	if write, ok := originPerms[normalizeOrigin(origin)]; ok {
+		return write, true
+	}
+	write, ok := originPerms["*"]
+	return write, ok
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf16"
+)
+
+// TextPatch replaces Delete code units at Offset with Insert. Offsets and
+// lengths are in UTF-16 code units, matching JavaScript string indices and
+// Monaco editor offsets.
+type TextPatch struct {
+	Offset int    `json:"offset"`
+	Delete int    `json:"delete,omitempty"`
+	Insert string `json:"insert,omitempty"`
+}
+
+// applyPatches applies patches to content in order, each against the result
+// of the previous one. It fails without partial application if any patch
+// falls outside the content.
+func applyPatches(content string, patches []TextPatch) (string, error) {
+	units := utf16.Encode([]rune(content))
+	for i, p := range patches {
+		if p.Offset < 0 || p.Delete < 0 || p.Offset > len(units) || p.Delete > len(units)-p.Offset {
+			return "", fmt.Errorf("patch %d out of range (offset %d, delete %d, length %d)", i, p.Offset, p.Delete, len(units))
+		}
+
+		insert := utf16.Encode([]rune(p.Insert))
+		next := make([]uint16, 0, len(units)-p.Delete+len(insert))
+		next = append(next, units[:p.Offset]...)
+		next = append(next, insert...)
+		next = append(next, units[p.Offset+p.Delete:]...)
+		units = next
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+// cutRange removes length code units at offset from content, returning the
+// remainder and the removed text. Like TextPatch, offsets are in UTF-16
+// code units.
+func cutRange(content string, offset, length int) (rest, cut string, err error) {
+	units := utf16.Encode([]rune(content))
+	if offset < 0 || length < 0 || offset > len(units) || length > len(units)-offset {
+		return "", "", fmt.Errorf("range out of bounds (offset %d, length %d, content length %d)", offset, length, len(units))
+	}
+
+	cut = string(utf16.Decode(units[offset : offset+length]))
+	rest = string(utf16.Decode(append(units[:offset:offset], units[offset+length:]...)))
+	return rest, cut, nil
+}
+
+// textDelta returns a patch turning old into new: the span between their
+// common prefix and common suffix. Offsets are in UTF-16 code units, and
+// the span never splits a surrogate pair.
+func textDelta(old, new string) TextPatch {
+	a, b := utf16.Encode([]rune(old)), utf16.Encode([]rune(new))
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	if prefix > 0 && a[prefix-1] >= 0xD800 && a[prefix-1] < 0xDC00 {
+		prefix-- // don't end the prefix on a high surrogate
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if suffix > 0 && a[len(a)-suffix] >= 0xDC00 && a[len(a)-suffix] < 0xE000 {
+		suffix-- // or start the suffix on a low surrogate
+	}
+	return TextPatch{
+		Offset: prefix,
+		Delete: len(a) - prefix - suffix,
+		Insert: string(utf16.Decode(b[prefix : len(b)-suffix])),
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestApplyPatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		patches []TextPatch
+		want    string
+		wantErr bool
+	}{
+		{"insert", "hello", []TextPatch{{Offset: 5, Insert: " world"}}, "hello world", false},
+		{"replace", "hello", []TextPatch{{Offset: 0, Delete: 1, Insert: "j"}}, "jello", false},
+		{"delete to end", "hello", []TextPatch{{Offset: 1, Delete: 4}}, "h", false},
+		{"in sequence", "abc", []TextPatch{{Offset: 3, Insert: "d"}, {Offset: 0, Delete: 1}}, "bcd", false},
+		{"surrogate pair", "a😀b", []TextPatch{{Offset: 1, Delete: 2}}, "ab", false},
+		{"offset past end", "hello", []TextPatch{{Offset: 6}}, "", true},
+		{"delete past end", "hello", []TextPatch{{Offset: 1, Delete: 5}}, "", true},
+		{"negative offset", "hello", []TextPatch{{Offset: -1}}, "", true},
+		{"negative delete", "hello", []TextPatch{{Delete: -1}}, "", true},
+		{"overflowing delete", "hello", []TextPatch{{Offset: 1, Delete: math.MaxInt}}, "", true},
+		{"overflowing offset", "hello", []TextPatch{{Offset: math.MaxInt, Delete: 1}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyPatches(tt.content, tt.patches)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyPatches() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("applyPatches() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCutRange(t *testing.T) {
+	tests := []struct {
+		name           string
+		content        string
+		offset, length int
+		rest, cut      string
+		wantErr        bool
+	}{
+		{"middle", "hello", 1, 3, "ho", "ell", false},
+		{"whole", "hello", 0, 5, "", "hello", false},
+		{"empty at end", "hello", 5, 0, "hello", "", false},
+		{"surrogate pair", "a😀b", 1, 2, "ab", "😀", false},
+		{"past end", "hello", 3, 3, "", "", true},
+		{"offset past end", "hello", 6, 0, "", "", true},
+		{"negative", "hello", -1, 1, "", "", true},
+		{"overflowing length", "hello", 1, math.MaxInt, "", "", true},
+		{"overflowing offset", "hello", math.MaxInt, 1, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rest, cut, err := cutRange(tt.content, tt.offset, tt.length)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cutRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if rest != tt.rest || cut != tt.cut {
+				t.Errorf("cutRange() = %q, %q, want %q, %q", rest, cut, tt.rest, tt.cut)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// seedTabs creates a tab for every file in dir whose name, without its
+// extension, no active tab has. With overwrite, tabs that do exist get the
+// file's content, their previous content going to history first. It runs
+// at startup, after tabs are loaded and before the hub starts, so it
+// doesn't take h.mu. Hidden files, directories and files that aren't text
+// are skipped with a log line.
+func (h *Hub) seedTabs(dir string, overwrite bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read seed directory: %w", err)
+	}
+
+	created, updated := 0, 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name, err := cleanName(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		if err != nil {
+			log.Printf("Skipping seed file %s: %v", entry.Name(), err)
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("read seed file: %w", err)
+		}
+		if !utf8.Valid(data) || looksBinary(string(data)) {
+			log.Printf("Skipping seed file %s: not text", entry.Name())
+			continue
+		}
+		content := transformContent(string(data))
+
+		tab := h.tabNamed(name)
+		switch {
+		case tab == nil:
+			tab = &Tab{ID: h.uniqueSlug(name), Name: name, Content: content}
+			if err := h.storage.SaveTab(tab); err != nil {
+				return fmt.Errorf("save seeded tab %s: %w", name, err)
+			}
+			h.tabs[tab.ID] = tab
+			h.recordActivity(tab.ID, "created", "seeded from "+entry.Name())
+			created++
+		case overwrite && tab.Content != content:
+			if err := h.storage.SaveHistory(tab.ID, tab.Content); err != nil {
+				return fmt.Errorf("save history of tab %s: %w", name, err)
+			}
+			tab.Content = content
+			if err := h.storage.SaveTab(tab); err != nil {
+				return fmt.Errorf("save seeded tab %s: %w", name, err)
+			}
+			h.recordActivity(tab.ID, "updated", "seeded from "+entry.Name())
+			updated++
+		}
+	}
+	log.Printf("Seeded tabs from %s: %d created, %d updated", dir, created, updated)
+	return nil
+}
+
+// tabNamed returns the active tab called name, ignoring case, or nil.
+func (h *Hub) tabNamed(name string) *Tab {
+	for _, tab := range h.tabs {
+		if strings.EqualFold(tab.Name, name) {
+			return tab
+		}
+	}
+	return nil
+}
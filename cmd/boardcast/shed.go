@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// overload describes why the hub is too busy to take on new work, or is
+// empty when it isn't. The hub is overloaded while its broadcast channel is
+// at least --shed-threshold full or --shed-max-clients clients are
+// connected.
+func (h *Hub) overload() string {
+	if used, size := len(h.broadcast), cap(h.broadcast); *shedLevel > 0 && size > 0 && float64(used) >= *shedLevel*float64(size) {
+		return fmt.Sprintf("broadcast channel %d/%d full", used, size)
+	}
+	if *shedClients > 0 {
+		h.clientsMu.RLock()
+		n := len(h.clients)
+		h.clientsMu.RUnlock()
+		if n >= *shedClients {
+			return fmt.Sprintf("%d clients connected", n)
+		}
+	}
+	return ""
+}
+
+// shedLoad rejects r with 503 and reports true when the hub is overloaded.
+// It guards requests that start new work, such as connections, uploads and
+// snapshots; clients already connected keep being served.
+func shedLoad(hub *Hub, w http.ResponseWriter, r *http.Request) bool {
+	reason := hub.overload()
+	if reason == "" {
+		return false
+	}
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "Server overloaded, try again later", http.StatusServiceUnavailable)
+	log.Printf("[%s] Shed %s %s: %s", requestID(r), r.Method, r.URL.Path, reason)
+	return true
+}
@@ -1,16 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 type Storage struct {
 	db *sql.DB
+
+	// keepAlive holds a connection open for an in-memory database, which
+	// SQLite discards when its last connection closes.
+	keepAlive *sql.Conn
+
+	// writeErr is the last write failure caused by the database itself
+	// (read-only, I/O error, disk full), or nil once writes succeed again.
+	// onWriteHealth, when set, is called whenever it changes.
+	healthMu      sync.Mutex
+	writeErr      error
+	onWriteHealth func(err error)
+
+	// aead encrypts content columns and image data at rest when
+	// --encryption-key-file is set; see seal and open.
+	aead cipher.AEAD
+
+	// encryptAll encrypts everything listed above; otherwise only tabs
+	// marked encrypted, with their history, and snapshots holding them
+	// are (--encryption-scope).
+	encryptAll bool
+
+	// historyDiffs stores history entries as deltas against the previous
+	// entry of the tab (--history-diffs); see SaveHistory.
+	historyDiffs bool
 }
 
 type TabRecord struct {
@@ -25,6 +61,17 @@ type HistoryRecord struct {
 	TabID   string
 	Content string
 	Created time.Time
+	Label   string // set by label-history; labeled entries survive pruning
+}
+
+// ActivityRecord is one entry in a tab's changelog: something that happened
+// to the tab, as opposed to a copy of its content.
+type ActivityRecord struct {
+	ID      int
+	TabID   string
+	Event   string // created, renamed, cleared, archived or restored
+	Detail  string
+	Created time.Time
 }
 
 type SnapshotRecord struct {
@@ -35,29 +82,117 @@ type SnapshotRecord struct {
 	Created     time.Time
 }
 
+type TemplateRecord struct {
+	Name    string
+	Content string
+	Created time.Time
+}
+
 type ImageRecord struct {
 	ID       string
 	Filename string
-	Data     []byte
+	Alt      string
+	Data     []byte `json:"-"`
 	MimeType string
 	Size     int64
+	Hash     string // hex SHA-256 of the image bytes; empty for old rows
 	Created  time.Time
 }
 
-func NewStorage(dataDir string) (*Storage, error) {
-	db, err := sql.Open("sqlite", dataDir+"/boardcast.db")
+// NewStorage opens the database in dataDir. Each pragma, e.g.
+// "synchronous(NORMAL)", is applied to every connection in the pool.
+func NewStorage(dataDir string, pragmas ...string) (*Storage, error) {
+	if dataDir == "" {
+		return nil, errors.New("no data directory given")
+	}
+	dsn := dataDir + "/boardcast.db"
+	if q := pragmaQuery(pragmas); len(q) > 0 {
+		dsn += "?" + q.Encode()
+	}
+
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, err
 	}
 
 	storage := &Storage{db: db}
+	if err := checkIntegrity(db, dataDir+"/boardcast.db"); err != nil {
+		db.Close()
+		return nil, err
+	}
 	if err := storage.initSchema(); err != nil {
 		return nil, err
 	}
+	if err := storage.checkWritable(dataDir); err != nil {
+		return nil, fmt.Errorf("data directory is not writable: %w", err)
+	}
+
+	return storage, nil
+}
+
+// memoryDatabases numbers in-memory databases, so that each gets its own.
+var memoryDatabases atomic.Uint64
+
+// NewMemoryStorage opens a new, empty in-memory database that is gone when
+// it is closed or the process exits. pragmas are as for NewStorage.
+func NewMemoryStorage(pragmas ...string) (*Storage, error) {
+	// A named shared-cache database, so every connection in the pool sees
+	// the same data. Connections from other Storages use other names.
+	q := pragmaQuery(pragmas)
+	q.Set("mode", "memory")
+	q.Set("cache", "shared")
+	dsn := fmt.Sprintf("file:boardcast-%d?%s", memoryDatabases.Add(1), q.Encode())
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
 
+	storage := &Storage{db: db}
+	if storage.keepAlive, err = db.Conn(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := storage.initSchema(); err != nil {
+		storage.Close()
+		return nil, err
+	}
 	return storage, nil
 }
 
+func pragmaQuery(pragmas []string) url.Values {
+	q := url.Values{}
+	for _, p := range pragmas {
+		q.Add("_pragma", p)
+	}
+	return q
+}
+
+// OpenStorageReadOnly opens the database in dataDir for reading only, for
+// offline tools such as boardcast export. The schema is not migrated, so
+// the database must have been opened by a server of this version first.
+func OpenStorageReadOnly(dataDir string) (*Storage, error) {
+	path := dataDir + "/boardcast.db"
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("read schema version: %w", err)
+	}
+	if version != len(migrations) {
+		db.Close()
+		return nil, fmt.Errorf("database schema version %d does not match this build (%d); run the matching boardcast server once first", version, len(migrations))
+	}
+	return &Storage{db: db}, nil
+}
+
 func (s *Storage) initSchema() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS tabs (
@@ -92,35 +227,198 @@ func (s *Storage) initSchema() error {
 		created DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 
+	CREATE TABLE IF NOT EXISTS templates (
+		name TEXT PRIMARY KEY,
+		content TEXT NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS activity (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tab_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_history_tab ON history(tab_id, created DESC);
+	CREATE INDEX IF NOT EXISTS idx_activity_tab ON activity(tab_id, id);
 	CREATE INDEX IF NOT EXISTS idx_snapshots_created ON snapshots(created DESC);
 	`
 
-	_, err := s.db.Exec(schema)
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+
+	return s.migrate()
+}
+
+// checkWritable verifies at startup that both the data directory and the
+// database accept writes, so a read-only volume fails fast instead of
+// silently dropping edits.
+func (s *Storage) checkWritable(dataDir string) error {
+	f, err := os.CreateTemp(dataDir, ".write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	// Rewriting user_version with its current value is a real write that
+	// changes nothing.
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
 	return err
 }
 
+// exec runs a write statement and records whether storage is accepting
+// writes; see WriteError.
+func (s *Storage) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := s.db.Exec(query, args...)
+	s.recordWrite(err)
+	return res, err
+}
+
+// recordWrite tracks storage health from a write result. Errors from the
+// statement itself, such as constraint violations, don't count.
+func (s *Storage) recordWrite(err error) {
+	var sqliteErr *sqlite.Error
+	if err != nil && !(errors.As(err, &sqliteErr) && isStorageFailure(sqliteErr.Code())) {
+		return
+	}
+
+	s.healthMu.Lock()
+	changed := (err == nil) != (s.writeErr == nil)
+	s.writeErr = err
+	notify := s.onWriteHealth
+	s.healthMu.Unlock()
+
+	if changed && notify != nil {
+		notify(err)
+	}
+}
+
+func isStorageFailure(code int) bool {
+	switch code & 0xff {
+	case sqlite3.SQLITE_READONLY, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_FULL, sqlite3.SQLITE_CANTOPEN:
+		return true
+	}
+	return false
+}
+
+// WriteError returns the current storage write failure, or nil if writes
+// are succeeding.
+func (s *Storage) WriteError() error {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	return s.writeErr
+}
+
 func (s *Storage) SaveTab(tab *Tab) error {
-	_, err := s.db.Exec(
-		"INSERT OR REPLACE INTO tabs (id, name, content, updated) VALUES (?, ?, ?, ?)",
-		tab.ID, tab.Name, tab.Content, time.Now(),
+	tags, err := json.Marshal(tab.Tags)
+	if err != nil {
+		return err
+	}
+	if tab.Tags == nil {
+		tags = []byte("[]")
+	}
+	locales, err := json.Marshal(tab.Locales)
+	if err != nil {
+		return err
+	}
+	if tab.Locales == nil {
+		locales = []byte("{}")
+	}
+
+	var expiresAt sql.NullTime
+	if tab.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: *tab.ExpiresAt, Valid: true}
+	}
+
+	tab.Updated = time.Now()
+	_, err = s.exec(
+		"INSERT OR REPLACE INTO tabs (id, name, content, archived, language, tags, expires_at, render_mode, pinned, color, locales, encrypted, updated) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		tab.ID, tab.Name, s.sealIf(s.encryptAll || tab.Encrypted, tab.Content), tab.Archived, tab.Language, string(tags), expiresAt, tab.RenderMode, tab.Pinned, tab.Color, s.sealIf(s.encryptAll || tab.Encrypted, string(locales)), tab.Encrypted, tab.Updated,
 	)
 	return err
 }
 
+// ImportTab saves tab like SaveTab, but keeps its Updated time when it has
+// one, so imported tabs keep their order.
+func (s *Storage) ImportTab(tab *Tab) error {
+	updated := tab.Updated
+	if err := s.SaveTab(tab); err != nil || updated.IsZero() {
+		return err
+	}
+	tab.Updated = updated
+	_, err := s.exec("UPDATE tabs SET updated = ? WHERE id = ?", updated, tab.ID)
+	return err
+}
+
+// LoadTabs returns the active (non-archived) tabs.
 func (s *Storage) LoadTabs() ([]*Tab, error) {
-	rows, err := s.db.Query("SELECT id, name, content FROM tabs ORDER BY updated DESC")
+	return s.queryTabs("WHERE archived = 0")
+}
+
+func (s *Storage) LoadArchivedTabs() ([]*Tab, error) {
+	return s.queryTabs("WHERE archived = 1")
+}
+
+func (s *Storage) GetTab(tabID string) (*Tab, error) {
+	tabs, err := s.queryTabs("WHERE id = ?", tabID)
+	if err != nil {
+		return nil, err
+	}
+	if len(tabs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return tabs[0], nil
+}
+
+// LoadTabsSince returns the active tabs, or the archived ones, saved after
+// since, least recently updated first.
+func (s *Storage) LoadTabsSince(since time.Time, archived bool) ([]*Tab, error) {
+	return s.queryTabsOrdered("WHERE archived = ? AND updated > ?", "updated", archived, since)
+}
+
+func (s *Storage) queryTabs(where string, args ...interface{}) ([]*Tab, error) {
+	return s.queryTabsOrdered(where, "pinned DESC, updated DESC", args...)
+}
+
+func (s *Storage) queryTabsOrdered(where, order string, args ...interface{}) ([]*Tab, error) {
+	rows, err := s.db.Query("SELECT id, name, content, archived, language, tags, expires_at, render_mode, pinned, color, locales, encrypted, updated FROM tabs "+where+" ORDER BY "+order, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var tabs []*Tab
+	tabs := []*Tab{}
 	for rows.Next() {
 		tab := &Tab{}
-		if err := rows.Scan(&tab.ID, &tab.Name, &tab.Content); err != nil {
+		var tags, locales string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&tab.ID, &tab.Name, &tab.Content, &tab.Archived, &tab.Language, &tags, &expiresAt, &tab.RenderMode, &tab.Pinned, &tab.Color, &locales, &tab.Encrypted, &tab.Updated); err != nil {
 			return nil, err
 		}
+		if expiresAt.Valid {
+			tab.ExpiresAt = &expiresAt.Time
+		}
+		if tab.Content, err = s.open(tab.Content); err != nil {
+			return nil, fmt.Errorf("tab %s: %w", tab.ID, err)
+		}
+		if locales, err = s.open(locales); err != nil {
+			return nil, fmt.Errorf("tab %s: %w", tab.ID, err)
+		}
+		if err := json.Unmarshal([]byte(tags), &tab.Tags); err != nil {
+			log.Printf("Ignoring malformed tags for tab %s: %v", tab.ID, err)
+		}
+		if err := json.Unmarshal([]byte(locales), &tab.Locales); err != nil {
+			log.Printf("Ignoring malformed locales for tab %s: %v", tab.ID, err)
+		}
+		tab.countText()
 		tabs = append(tabs, tab)
 	}
 
@@ -128,21 +426,162 @@ func (s *Storage) LoadTabs() ([]*Tab, error) {
 }
 
 func (s *Storage) DeleteTab(tabID string) error {
-	_, err := s.db.Exec("DELETE FROM tabs WHERE id = ?", tabID)
+	if _, err := s.exec("DELETE FROM tabs WHERE id = ?", tabID); err != nil {
+		return err
+	}
+	_, err := s.exec("DELETE FROM activity WHERE tab_id = ?", tabID)
 	return err
 }
 
+func (s *Storage) AddActivity(tabID, event, detail string) error {
+	_, err := s.exec(
+		"INSERT INTO activity (tab_id, event, detail, created) VALUES (?, ?, ?, ?)",
+		tabID, event, detail, time.Now(),
+	)
+	return err
+}
+
+// GetActivity returns a tab's changelog, oldest first.
+func (s *Storage) GetActivity(tabID string) ([]ActivityRecord, error) {
+	rows, err := s.db.Query(
+		"SELECT id, tab_id, event, detail, created FROM activity WHERE tab_id = ? ORDER BY id",
+		tabID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []ActivityRecord{}
+	for rows.Next() {
+		var rec ActivityRecord
+		if err := rows.Scan(&rec.ID, &rec.TabID, &rec.Event, &rec.Detail, &rec.Created); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+// historyAnchorEvery bounds how many history entries in a row are stored as
+// deltas: every so often an entry is stored in full again, so reading one
+// never replays more than this many deltas.
+const historyAnchorEvery = 20
+
+// SaveHistory records content as a new history entry of tabID. With
+// historyDiffs set the entry is stored as a delta against the tab's previous
+// entry, unless the delta wouldn't be smaller or the chain is already
+// historyAnchorEvery long.
 func (s *Storage) SaveHistory(tabID, content string) error {
-	_, err := s.db.Exec(
-		"INSERT INTO history (tab_id, content, created) VALUES (?, ?, ?)",
-		tabID, content, time.Now(),
+	stored, baseID := content, 0
+	if s.historyDiffs {
+		var err error
+		if stored, baseID, err = s.historyDelta(tabID, content); err != nil {
+			return err
+		}
+	}
+	_, err := s.exec(
+		"INSERT INTO history (tab_id, content, created, base_id) VALUES (?, ?, ?, ?)",
+		tabID, s.sealIf(s.tabEncrypted(tabID), stored), time.Now(), baseID,
 	)
 	return err
 }
 
+// historyDelta returns content encoded as a delta against tabID's newest
+// history entry and that entry's ID, or content itself and 0 when it is
+// better stored in full.
+func (s *Storage) historyDelta(tabID, content string) (string, int, error) {
+	var prevID int
+	err := s.db.QueryRow("SELECT id FROM history WHERE tab_id = ? ORDER BY created DESC, id DESC LIMIT 1", tabID).Scan(&prevID)
+	if err == sql.ErrNoRows {
+		return content, 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	prev, depth, err := newHistoryResolver(s).load(prevID)
+	if err != nil {
+		return "", 0, err
+	}
+	if depth+1 >= historyAnchorEvery {
+		return content, 0, nil
+	}
+	delta, err := json.Marshal(lineDelta(prev, content))
+	if err != nil || len(delta) >= len(content) {
+		return content, 0, err
+	}
+	return string(delta), prevID, nil
+}
+
+// historyResolver rebuilds history entries stored as deltas. Versions it
+// rebuilds are cached, so entries sharing a chain are replayed once.
+type historyResolver struct {
+	s     *Storage
+	cache map[int]resolvedHistory
+}
+
+type resolvedHistory struct {
+	content string
+	depth   int // deltas replayed to get content
+}
+
+func newHistoryResolver(s *Storage) *historyResolver {
+	return &historyResolver{s: s, cache: make(map[int]resolvedHistory)}
+}
+
+// resolve returns the content of the entry id as read from the database:
+// its stored, still sealed, content and the entry it is based on.
+func (r *historyResolver) resolve(id int, stored string, baseID int) (string, int, error) {
+	if cached, ok := r.cache[id]; ok {
+		return cached.content, cached.depth, nil
+	}
+	content, err := r.s.open(stored)
+	if err != nil {
+		return "", 0, err
+	}
+	depth := 0
+	if baseID != 0 {
+		base, baseDepth, err := r.load(baseID)
+		if err != nil {
+			return "", 0, err
+		}
+		var ops []deltaOp
+		if err := json.Unmarshal([]byte(content), &ops); err != nil {
+			return "", 0, fmt.Errorf("history %d: %w", id, err)
+		}
+		if content, err = applyDelta(base, ops); err != nil {
+			return "", 0, fmt.Errorf("history %d: %w", id, err)
+		}
+		depth = baseDepth + 1
+	}
+
+	// Long walks through a tab's history only ever need the latest
+	// versions, so the cache is dropped rather than left to grow.
+	if len(r.cache) >= 2*historyAnchorEvery {
+		clear(r.cache)
+	}
+	r.cache[id] = resolvedHistory{content, depth}
+	return content, depth, nil
+}
+
+// load is resolve for an entry not read yet.
+func (r *historyResolver) load(id int) (string, int, error) {
+	if cached, ok := r.cache[id]; ok {
+		return cached.content, cached.depth, nil
+	}
+	var stored string
+	var baseID int
+	if err := r.s.db.QueryRow("SELECT content, base_id FROM history WHERE id = ?", id).Scan(&stored, &baseID); err != nil {
+		return "", 0, fmt.Errorf("history %d: %w", id, err)
+	}
+	return r.resolve(id, stored, baseID)
+}
+
 func (s *Storage) GetHistory(tabID string, limit int) ([]HistoryRecord, error) {
 	rows, err := s.db.Query(
-		"SELECT id, tab_id, content, created FROM history WHERE tab_id = ? ORDER BY created DESC LIMIT ?",
+		"SELECT id, tab_id, content, created, label, base_id FROM history WHERE tab_id = ? ORDER BY created DESC LIMIT ?",
 		tabID, limit,
 	)
 	if err != nil {
@@ -151,9 +590,14 @@ func (s *Storage) GetHistory(tabID string, limit int) ([]HistoryRecord, error) {
 	defer rows.Close()
 
 	var records []HistoryRecord
+	resolver := newHistoryResolver(s)
 	for rows.Next() {
 		var rec HistoryRecord
-		if err := rows.Scan(&rec.ID, &rec.TabID, &rec.Content, &rec.Created); err != nil {
+		var baseID int
+		if err := rows.Scan(&rec.ID, &rec.TabID, &rec.Content, &rec.Created, &rec.Label, &baseID); err != nil {
+			return nil, err
+		}
+		if rec.Content, _, err = resolver.resolve(rec.ID, rec.Content, baseID); err != nil {
 			return nil, err
 		}
 		records = append(records, rec)
@@ -162,15 +606,176 @@ func (s *Storage) GetHistory(tabID string, limit int) ([]HistoryRecord, error) {
 	return records, nil
 }
 
-func (s *Storage) CreateSnapshot(name, description string, tabs []*Tab) error {
-	tabsJSON, err := json.Marshal(tabs)
+// EachHistory calls fn with each of tabID's history entries, oldest first,
+// reading them one at a time so long histories needn't fit in memory. It
+// stops at the first error from fn.
+func (s *Storage) EachHistory(tabID string, fn func(HistoryRecord) error) error {
+	rows, err := s.db.Query(
+		"SELECT id, tab_id, content, created, label, base_id FROM history WHERE tab_id = ? ORDER BY created, id",
+		tabID,
+	)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
+
+	resolver := newHistoryResolver(s)
+	for rows.Next() {
+		var rec HistoryRecord
+		var baseID int
+		if err := rows.Scan(&rec.ID, &rec.TabID, &rec.Content, &rec.Created, &rec.Label, &baseID); err != nil {
+			return err
+		}
+		if rec.Content, _, err = resolver.resolve(rec.ID, rec.Content, baseID); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ImportHistory adds history entries for tabID, keeping their original
+// timestamps. Entries without one are dated now.
+func (s *Storage) ImportHistory(tabID string, records []HistoryRecord) error {
+	encrypt := s.tabEncrypted(tabID)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rec := range records {
+		created := rec.Created
+		if created.IsZero() {
+			created = time.Now()
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO history (tab_id, content, created, label) VALUES (?, ?, ?, ?)",
+			tabID, s.sealIf(encrypt, rec.Content), created, rec.Label,
+		); err != nil {
+			s.recordWrite(err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	s.recordWrite(err)
+	return err
+}
+
+// LabelHistory sets the label of one of tabID's history entries, or clears
+// it for an empty label. It reports whether the entry exists.
+func (s *Storage) LabelHistory(tabID string, historyID int, label string) (bool, error) {
+	res, err := s.exec("UPDATE history SET label = ? WHERE id = ? AND tab_id = ?", label, historyID, tabID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ResealHistory rewrites tabID's history after its encrypted flag changed,
+// encrypting or decrypting each entry to match.
+func (s *Storage) ResealHistory(tabID string) error {
+	encrypt := s.tabEncrypted(tabID)
+	rows, err := s.db.Query("SELECT id, content FROM history WHERE tab_id = ?", tabID)
+	if err != nil {
+		return err
+	}
+	contents := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return err
+		}
+		if contents[id], err = s.open(content); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, content := range contents {
+		if _, err := tx.Exec("UPDATE history SET content = ? WHERE id = ?", s.sealIf(encrypt, content), id); err != nil {
+			s.recordWrite(err)
+			return err
+		}
+	}
+	err = tx.Commit()
+	s.recordWrite(err)
+	return err
+}
+
+// SnapshotTooLargeError is returned by CreateSnapshot when the marshaled
+// tabs exceed the size limit.
+type SnapshotTooLargeError struct {
+	Size  int
+	Limit int64
+}
+
+func (e *SnapshotTooLargeError) Error() string {
+	return fmt.Sprintf("snapshot is %d bytes, over the %d byte limit", e.Size, e.Limit)
+}
+
+// CreateSnapshot stores tabs under name. A positive maxSize caps the size
+// of the marshaled tabs; larger snapshots fail with SnapshotTooLargeError
+// before anything is written. With overwrite, the newest snapshot already
+// named name is updated in place instead, keeping its ID; replaced reports
+// whether that happened.
+func (s *Storage) CreateSnapshot(name, description string, tabs []*Tab, maxSize int64, overwrite bool) (replaced bool, err error) {
+	tabsJSON, err := json.Marshal(tabs)
+	if err != nil {
+		return false, err
+	}
+	if maxSize > 0 && int64(len(tabsJSON)) > maxSize {
+		return false, &SnapshotTooLargeError{Size: len(tabsJSON), Limit: maxSize}
+	}
+	encrypt := s.encryptAll
+	for _, tab := range tabs {
+		encrypt = encrypt || tab.Encrypted
+	}
+	data := s.sealIf(encrypt, string(tabsJSON))
 
-	_, err = s.db.Exec(
+	if overwrite {
+		res, err := s.exec(`
+			UPDATE snapshots SET description = ?, tabs_data = ?, created = ?
+			WHERE id = (SELECT id FROM snapshots WHERE name = ? ORDER BY created DESC LIMIT 1)
+		`, description, data, time.Now(), name)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return true, nil
+		}
+	}
+
+	_, err = s.exec(
 		"INSERT INTO snapshots (name, description, tabs_data, created) VALUES (?, ?, ?, ?)",
-		name, description, string(tabsJSON), time.Now(),
+		name, description, data, time.Now(),
+	)
+	return false, err
+}
+
+// ImportSnapshot adds a snapshot with its original name, description and
+// time, under a new ID.
+func (s *Storage) ImportSnapshot(rec SnapshotRecord) error {
+	var tabs []struct{ Encrypted bool }
+	json.Unmarshal([]byte(rec.TabsData), &tabs)
+	encrypt := s.encryptAll
+	for _, tab := range tabs {
+		encrypt = encrypt || tab.Encrypted
+	}
+	_, err := s.exec(
+		"INSERT INTO snapshots (name, description, tabs_data, created) VALUES (?, ?, ?, ?)",
+		rec.Name, rec.Description, s.sealIf(encrypt, rec.TabsData), rec.Created,
 	)
 	return err
 }
@@ -191,48 +796,226 @@ func (s *Storage) GetSnapshots(limit int) ([]SnapshotRecord, error) {
 		if err := rows.Scan(&rec.ID, &rec.Name, &rec.Description, &rec.TabsData, &rec.Created); err != nil {
 			return nil, err
 		}
+		if rec.TabsData, err = s.open(rec.TabsData); err != nil {
+			return nil, err
+		}
 		records = append(records, rec)
 	}
 
 	return records, nil
 }
 
+func (s *Storage) GetSnapshot(snapshotID int) (*SnapshotRecord, error) {
+	var rec SnapshotRecord
+	err := s.db.QueryRow(
+		"SELECT id, name, description, tabs_data, created FROM snapshots WHERE id = ?",
+		snapshotID,
+	).Scan(&rec.ID, &rec.Name, &rec.Description, &rec.TabsData, &rec.Created)
+	if err != nil {
+		return nil, err
+	}
+	if rec.TabsData, err = s.open(rec.TabsData); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *Storage) CountSnapshots() (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM snapshots").Scan(&n)
+	return n, err
+}
+
+// SnapshotNameExists reports whether a snapshot called name exists, i.e.
+// whether an overwriting CreateSnapshot would replace one.
+func (s *Storage) SnapshotNameExists(name string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM snapshots WHERE name = ?)", name).Scan(&exists)
+	return exists, err
+}
+
+// PruneSnapshots deletes all but the newest keep snapshots.
+func (s *Storage) PruneSnapshots(keep int) (int64, error) {
+	res, err := s.exec(
+		"DELETE FROM snapshots WHERE id NOT IN (SELECT id FROM snapshots ORDER BY created DESC LIMIT ?)",
+		keep,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (s *Storage) DeleteSnapshot(snapshotID int) error {
-	_, err := s.db.Exec("DELETE FROM snapshots WHERE id = ?", snapshotID)
+	_, err := s.exec("DELETE FROM snapshots WHERE id = ?", snapshotID)
+	return err
+}
+
+func (s *Storage) SaveTemplate(name, content string) error {
+	_, err := s.exec(
+		"INSERT OR REPLACE INTO templates (name, content, created) VALUES (?, ?, ?)",
+		name, s.seal(content), time.Now(),
+	)
+	return err
+}
+
+func (s *Storage) GetTemplate(name string) (*TemplateRecord, error) {
+	var rec TemplateRecord
+	err := s.db.QueryRow(
+		"SELECT name, content, created FROM templates WHERE name = ?",
+		name,
+	).Scan(&rec.Name, &rec.Content, &rec.Created)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Content, err = s.open(rec.Content); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *Storage) GetTemplates() ([]TemplateRecord, error) {
+	rows, err := s.db.Query("SELECT name, content, created FROM templates ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []TemplateRecord
+	for rows.Next() {
+		var rec TemplateRecord
+		if err := rows.Scan(&rec.Name, &rec.Content, &rec.Created); err != nil {
+			return nil, err
+		}
+		if rec.Content, err = s.open(rec.Content); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+func (s *Storage) DeleteTemplate(name string) error {
+	_, err := s.exec("DELETE FROM templates WHERE name = ?", name)
 	return err
 }
 
 func (s *Storage) SaveImage(img *ImageRecord) error {
-	_, err := s.db.Exec(
-		"INSERT INTO images (id, filename, data, mime_type, size, created) VALUES (?, ?, ?, ?, ?, ?)",
-		img.ID, img.Filename, img.Data, img.MimeType, img.Size, time.Now(),
+	if img.Hash == "" {
+		img.Hash = sha256Hex(img.Data)
+	}
+	_, err := s.exec(
+		"INSERT INTO images (id, filename, alt, data, mime_type, size, hash, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		img.ID, img.Filename, img.Alt, s.sealBytes(img.Data), img.MimeType, img.Size, img.Hash, time.Now(),
 	)
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return errImageIDTaken
+	}
 	return err
 }
 
+// ImageExists reports whether an image with imageID is stored.
+func (s *Storage) ImageExists(imageID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE id = ?)", imageID).Scan(&exists)
+	return exists, err
+}
+
 func (s *Storage) GetImage(imageID string) (*ImageRecord, error) {
 	var img ImageRecord
 	err := s.db.QueryRow(
-		"SELECT id, filename, data, mime_type, size, created FROM images WHERE id = ?",
+		"SELECT id, filename, alt, data, mime_type, size, hash, created FROM images WHERE id = ?",
 		imageID,
-	).Scan(&img.ID, &img.Filename, &img.Data, &img.MimeType, &img.Size, &img.Created)
+	).Scan(&img.ID, &img.Filename, &img.Alt, &img.Data, &img.MimeType, &img.Size, &img.Hash, &img.Created)
 	
 	if err != nil {
 		return nil, err
 	}
+	if img.Data, err = s.openBytes(img.Data); err != nil {
+		return nil, err
+	}
 	return &img, nil
 }
 
+// GetImageMeta is GetImage without the image data.
+func (s *Storage) GetImageMeta(imageID string) (*ImageRecord, error) {
+	var img ImageRecord
+	err := s.db.QueryRow(
+		"SELECT id, filename, alt, mime_type, size, hash, created FROM images WHERE id = ?",
+		imageID,
+	).Scan(&img.ID, &img.Filename, &img.Alt, &img.MimeType, &img.Size, &img.Hash, &img.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+// GetImages lists image metadata without the image data.
+func (s *Storage) GetImages(limit int) ([]ImageRecord, error) {
+	rows, err := s.db.Query(
+		"SELECT id, filename, alt, mime_type, size, hash, created FROM images ORDER BY created DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []ImageRecord
+	for rows.Next() {
+		var rec ImageRecord
+		if err := rows.Scan(&rec.ID, &rec.Filename, &rec.Alt, &rec.MimeType, &rec.Size, &rec.Hash, &rec.Created); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+
+	return records, nil
+}
+
+func (s *Storage) UpdateImageMeta(imageID, filename, alt string) error {
+	res, err := s.exec("UPDATE images SET filename = ?, alt = ? WHERE id = ?", filename, alt, imageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Storage) OpenImage(imageID string) (*ImageRecord, io.ReadCloser, error) {
+	img, err := s.GetImage(imageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, io.NopCloser(bytes.NewReader(img.Data)), nil
+}
+
+// Checkpoint copies the SQLite write-ahead log into the database file and
+// truncates it, so the file alone holds every committed write. It is a
+// no-op unless --sqlite-wal is on.
+func (s *Storage) Checkpoint() error {
+	_, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
 func (s *Storage) Close() error {
+	if s.keepAlive != nil {
+		s.keepAlive.Close()
+	}
 	return s.db.Close()
 }
 
+// CleanOldHistory keeps the newest keepCount unlabeled history entries of
+// tabID. Labeled entries are never pruned.
 func (s *Storage) CleanOldHistory(tabID string, keepCount int) error {
-	_, err := s.db.Exec(`
-		DELETE FROM history 
-		WHERE tab_id = ? AND id NOT IN (
+	_, err := s.deleteHistory(`
+		tab_id = ? AND label = '' AND id NOT IN (
 			SELECT id FROM history 
-			WHERE tab_id = ? 
+			WHERE tab_id = ? AND label = ''
 			ORDER BY created DESC 
 			LIMIT ?
 		)
@@ -240,6 +1023,187 @@ func (s *Storage) CleanOldHistory(tabID string, keepCount int) error {
 	return err
 }
 
+// DeleteHistoryBefore removes history entries created before the given
+// time and returns how many were deleted.
+func (s *Storage) DeleteHistoryBefore(before time.Time) (int64, error) {
+	res, err := s.deleteHistory("created < ?", before.Local())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// deleteHistory deletes the history entries matching where. Entries that
+// are kept but stored as deltas against deleted ones are first rewritten
+// in full.
+func (s *Storage) deleteHistory(where string, args ...interface{}) (sql.Result, error) {
+	rows, err := s.db.Query(
+		"SELECT id, tab_id FROM history WHERE base_id IN (SELECT id FROM history WHERE "+where+") AND NOT ("+where+")",
+		append(append([]interface{}{}, args...), args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	orphans := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var tabID string
+		if err := rows.Scan(&id, &tabID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orphans[id] = tabID
+	}
+	rows.Close()
+
+	resolver := newHistoryResolver(s)
+	for id, tabID := range orphans {
+		content, _, err := resolver.load(id)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.exec("UPDATE history SET content = ?, base_id = 0 WHERE id = ?", s.sealIf(s.tabEncrypted(tabID), content), id); err != nil {
+			return nil, err
+		}
+	}
+	return s.exec("DELETE FROM history WHERE "+where, args...)
+}
+
+// Reset deletes every tab, history entry, activity entry, snapshot and image in one
+// transaction and returns the IDs of the deleted images. Templates are kept.
+func (s *Storage) Reset() ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM images")
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, table := range []string{"history", "activity", "snapshots", "images", "tabs"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			s.recordWrite(err)
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	s.recordWrite(err)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UnreferencedImagesBefore lists images created before the given time whose
+// ID appears in no tab, history entry or snapshot.
+func (s *Storage) UnreferencedImagesBefore(before time.Time) ([]string, error) {
+	if s.aead != nil {
+		return s.unreferencedImagesDecrypted(before)
+	}
+	rows, err := s.db.Query(`
+		SELECT id FROM images
+		WHERE created < ?
+			AND NOT EXISTS (SELECT 1 FROM tabs WHERE instr(tabs.content, images.id) > 0)
+			AND NOT EXISTS (SELECT 1 FROM history WHERE instr(history.content, images.id) > 0)
+			AND NOT EXISTS (SELECT 1 FROM snapshots WHERE instr(snapshots.tabs_data, images.id) > 0)
+	`, before.Local())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// unreferencedImagesDecrypted is UnreferencedImagesBefore for encrypted
+// databases, where SQL can't search the content: every tab, history entry
+// and snapshot is decrypted and searched here instead.
+func (s *Storage) unreferencedImagesDecrypted(before time.Time) ([]string, error) {
+	candidates, err := s.queryStrings("SELECT id FROM images WHERE created < ?", before.Local())
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+
+	unreferenced := make(map[string]bool, len(candidates))
+	for _, id := range candidates {
+		unreferenced[id] = true
+	}
+	for _, query := range []string{
+		"SELECT content FROM tabs",
+		"SELECT content FROM history",
+		"SELECT tabs_data FROM snapshots",
+	} {
+		values, err := s.queryStrings(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			text, err := s.open(value)
+			if err != nil {
+				return nil, err
+			}
+			for id := range unreferenced {
+				if strings.Contains(text, id) {
+					delete(unreferenced, id)
+				}
+			}
+		}
+	}
+
+	var ids []string
+	for _, id := range candidates {
+		if unreferenced[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// queryStrings returns the single string column selected by query.
+func (s *Storage) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func (s *Storage) DeleteImage(imageID string) error {
+	_, err := s.exec("DELETE FROM images WHERE id = ?", imageID)
+	return err
+}
+
 func (s *Storage) AutoSaveHistory(hub *Hub) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
@@ -263,3 +1227,38 @@ func (s *Storage) AutoSaveHistory(hub *Hub) {
 		hub.mu.RUnlock()
 	}
 }
+
+// DebounceHistory records a history entry for each edited tab once it has
+// been idle for delay, so bursts of edits get their own version instead of
+// waiting for the next AutoSaveHistory tick.
+func (s *Storage) DebounceHistory(hub *Hub, delay time.Duration) {
+	interval := delay / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		pending := make(map[string]string)
+
+		hub.mu.Lock()
+		for tabID, edited := range hub.dirty {
+			if now.Sub(edited) < delay {
+				continue
+			}
+			if tab, exists := hub.tabs[tabID]; exists {
+				pending[tabID] = tab.Content
+			}
+			delete(hub.dirty, tabID)
+		}
+		hub.mu.Unlock()
+
+		for tabID, content := range pending {
+			if err := s.SaveHistory(tabID, content); err != nil {
+				log.Printf("Failed to save history for tab %s: %v", tabID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// newTestStorage opens a database in a temporary directory.
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	s, err := NewStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStorage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// historyVersions returns n versions of a 50-line document, each changing
+// one line of the one before, so they are stored as deltas.
+func historyVersions(n int) []string {
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d of a document long enough to be worth diffing", i)
+	}
+	versions := make([]string, n)
+	for v := range versions {
+		lines[v%len(lines)] = fmt.Sprintf("line %d, edited in version %d", v%len(lines), v)
+		versions[v] = strings.Join(lines, "\n")
+	}
+	return versions
+}
+
+// saveVersions stores versions as history of tabID, oldest first.
+func saveVersions(t *testing.T, s *Storage, tabID string, versions []string) {
+	t.Helper()
+	for _, content := range versions {
+		if err := s.SaveHistory(tabID, content); err != nil {
+			t.Fatalf("SaveHistory: %v", err)
+		}
+	}
+}
+
+// baseIDs returns the base_id of tabID's history entries, oldest first.
+func baseIDs(t *testing.T, s *Storage, tabID string) []int {
+	t.Helper()
+	rows, err := s.db.Query("SELECT base_id FROM history WHERE tab_id = ? ORDER BY created, id", tabID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// checkHistory fails unless tabID's history reads back as want, oldest
+// first, through both EachHistory and GetHistory.
+func checkHistory(t *testing.T, s *Storage, tabID string, want []string) {
+	t.Helper()
+	var got []string
+	err := s.EachHistory(tabID, func(rec HistoryRecord) error {
+		got = append(got, rec.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EachHistory: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("EachHistory returned %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("EachHistory entry %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	records, err := s.GetHistory(tabID, len(want))
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	for i, rec := range records {
+		if w := want[len(want)-1-i]; rec.Content != w {
+			t.Errorf("GetHistory entry %d = %q, want %q", i, rec.Content, w)
+		}
+	}
+}
+
+func TestHistoryDeltaChain(t *testing.T) {
+	s := newTestStorage(t)
+	s.historyDiffs = true
+	versions := historyVersions(10)
+	saveVersions(t, s, "notes", versions)
+
+	bases := baseIDs(t, s, "notes")
+	if bases[0] != 0 {
+		t.Errorf("first entry has base %d, want it stored in full", bases[0])
+	}
+	for i, base := range bases[1:] {
+		if base == 0 {
+			t.Errorf("entry %d is stored in full, want a delta", i+1)
+		}
+	}
+	checkHistory(t, s, "notes", versions)
+}
+
+func TestHistoryAnchors(t *testing.T) {
+	s := newTestStorage(t)
+	s.historyDiffs = true
+	versions := historyVersions(2*historyAnchorEvery + 5)
+	saveVersions(t, s, "notes", versions)
+
+	depth, anchors := 0, 0
+	for i, base := range baseIDs(t, s, "notes") {
+		if base == 0 {
+			depth = 0
+			anchors++
+			continue
+		}
+		depth++
+		if depth >= historyAnchorEvery {
+			t.Fatalf("entry %d is delta %d in a row, want at most %d", i, depth, historyAnchorEvery-1)
+		}
+	}
+	if anchors != 3 {
+		t.Errorf("%d entries stored in full, want 3", anchors)
+	}
+	checkHistory(t, s, "notes", versions)
+}
+
+func TestDeleteHistoryRewritesOrphans(t *testing.T) {
+	s := newTestStorage(t)
+	s.historyDiffs = true
+	versions := historyVersions(8)
+	saveVersions(t, s, "notes", versions)
+
+	if err := s.CleanOldHistory("notes", 3); err != nil {
+		t.Fatalf("CleanOldHistory: %v", err)
+	}
+	bases := baseIDs(t, s, "notes")
+	if len(bases) != 3 {
+		t.Fatalf("%d entries left, want 3", len(bases))
+	}
+	if bases[0] != 0 {
+		t.Errorf("oldest remaining entry still has deleted base %d", bases[0])
+	}
+	if bases[1] == 0 || bases[2] == 0 {
+		t.Errorf("later entries were rewritten in full: bases %v", bases)
+	}
+	checkHistory(t, s, "notes", versions[5:])
+}
+
+func TestHistoryWithoutDiffs(t *testing.T) {
+	s := newTestStorage(t)
+	versions := historyVersions(5)
+	saveVersions(t, s, "notes", versions)
+
+	for i, base := range baseIDs(t, s, "notes") {
+		if base != 0 {
+			t.Errorf("entry %d has base %d without --history-diffs", i, base)
+		}
+	}
+	checkHistory(t, s, "notes", versions)
+}
+
+func TestMemoryStoragesAreSeparate(t *testing.T) {
+	a, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatalf("NewMemoryStorage: %v", err)
+	}
+	defer a.Close()
+	b, err := NewMemoryStorage()
+	if err != nil {
+		t.Fatalf("NewMemoryStorage: %v", err)
+	}
+	defer b.Close()
+
+	if err := a.SaveTab(&Tab{ID: "notes", Name: "Notes", Content: "only in a"}); err != nil {
+		t.Fatalf("SaveTab: %v", err)
+	}
+	tabs, err := b.LoadTabs()
+	if err != nil {
+		t.Fatalf("LoadTabs: %v", err)
+	}
+	if len(tabs) != 0 {
+		t.Errorf("second store has %d tabs, want none", len(tabs))
+	}
+	if tabs, err := a.LoadTabs(); err != nil || len(tabs) != 1 {
+		t.Errorf("first store has %d tabs (%v), want 1", len(tabs), err)
+	}
+}
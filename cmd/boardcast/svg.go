@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const svgMimeType = "image/svg+xml"
+
+// svgBlockedElements are dropped from uploaded SVGs together with
+// everything inside them: they run script or embed other documents.
+var svgBlockedElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// looksLikeSVG reports whether data is an XML document with an svg root
+// element. http.DetectContentType reports SVGs as text/xml or text/plain.
+func looksLikeSVG(data []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			return false
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return strings.EqualFold(t.Name.Local, "svg")
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return false
+			}
+		}
+	}
+}
+
+// sanitizeSVG rewrites an SVG so it can't run script when opened on its
+// own: blocked elements are removed, as are event handler attributes and
+// links other than to fragments in the same document or embedded raster
+// images. Comments, processing instructions and DOCTYPEs are dropped; the
+// decoder refuses entities it doesn't know, so DTD entity tricks fail.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	out.WriteString(xml.Header)
+
+	skip := 0 // depth inside a blocked element
+	sawRoot := false
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if !sawRoot && !strings.EqualFold(t.Name.Local, "svg") {
+				return nil, errors.New("root element is not svg")
+			}
+			sawRoot = true
+			if skip > 0 || svgBlockedElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if !svgAttrAllowed(attr) {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if sawRoot && skip == 0 {
+				svgTextEscaper.WriteString(&out, string(t))
+			}
+		}
+	}
+	if !sawRoot {
+		return nil, errors.New("no svg element")
+	}
+	return out.Bytes(), nil
+}
+
+// svgAttrAllowed reports whether an attribute is kept by sanitizeSVG.
+func svgAttrAllowed(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	if name == "href" || name == "src" {
+		value := strings.TrimSpace(strings.ToLower(attr.Value))
+		return strings.HasPrefix(value, "#") ||
+			strings.HasPrefix(value, "data:image/png") ||
+			strings.HasPrefix(value, "data:image/jpeg") ||
+			strings.HasPrefix(value, "data:image/gif") ||
+			strings.HasPrefix(value, "data:image/webp")
+	}
+	// Animation elements can set href or on* attributes after load.
+	if name == "attributename" {
+		value := strings.TrimSpace(strings.ToLower(attr.Value))
+		return !strings.HasPrefix(value, "on") && !strings.HasSuffix(value, "href")
+	}
+	return true
+}
+
+// svgTextEscaper escapes character data. Unlike xml.EscapeText it leaves
+// line breaks alone, so the SVG stays readable.
+var svgTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
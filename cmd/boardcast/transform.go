@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ContentTransform rewrites tab content before it is stored and relayed,
+// e.g. to normalize formatting or strip secrets. It must return the content
+// unchanged when there is nothing to do.
+type ContentTransform func(content string) string
+
+// contentTransforms run in registration order on tab content and
+// translations whenever they are stored: on update, create, append, move,
+// set-locale-content, imports and seeding. Appends are transformed together
+// with the content they extend. They are registered at startup, before the
+// hub runs.
+var contentTransforms []ContentTransform
+
+func registerTransform(t ContentTransform) {
+	contentTransforms = append(contentTransforms, t)
+}
+
+// transformContent applies every registered transform to content.
+func transformContent(content string) string {
+	for _, t := range contentTransforms {
+		content = t(content)
+	}
+	return content
+}
+
+// registerBuiltinTransforms registers the transforms enabled by flags.
+func registerBuiltinTransforms() error {
+	if *lfEndings {
+		registerTransform(normalizeLineEndings)
+	}
+	if *trimTrailing {
+		registerTransform(trimTrailingWhitespace)
+	}
+	if *redactRegex != "" {
+		re, err := regexp.Compile(*redactRegex)
+		if err != nil {
+			return fmt.Errorf("invalid --redact-pattern: %w", err)
+		}
+		registerTransform(redactMatches(re))
+	}
+	return nil
+}
+
+// normalizeLineEndings converts CRLF line endings to LF, so content from
+// Windows clients doesn't differ from the same text typed elsewhere on
+// every line.
+func normalizeLineEndings(content string) string {
+	return strings.ReplaceAll(content, "\r\n", "\n")
+}
+
+// eolContent applies normalizeLineEndings when --normalize-line-endings is
+// set. It covers content that doesn't pass through transformContent:
+// imported history and snapshots.
+func eolContent(content string) string {
+	if !*lfEndings {
+		return content
+	}
+	return normalizeLineEndings(content)
+}
+
+// trimTrailingWhitespace removes spaces and tabs at the end of every line.
+func trimTrailingWhitespace(content string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redactMatches returns a transform replacing every match of re with
+// [REDACTED].
+func redactMatches(re *regexp.Regexp) ContentTransform {
+	return func(content string) string {
+		return re.ReplaceAllLiteralString(content, "[REDACTED]")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkedUpload is an image being uploaded in pieces. Received bytes are
+// kept in a temporary file until the upload is completed.
+type chunkedUpload struct {
+	mu       sync.Mutex
+	file     *os.File
+	received int64
+	filename string
+	expires  time.Time
+}
+
+// uploadTracker holds chunked uploads in progress. Uploads that see no
+// chunk for ttl are dropped along with their data.
+type uploadTracker struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	uploads map[string]*chunkedUpload
+}
+
+var chunkedUploads *uploadTracker
+
+func newUploadTracker(ttl time.Duration) *uploadTracker {
+	return &uploadTracker{ttl: ttl, uploads: make(map[string]*chunkedUpload)}
+}
+
+func (t *uploadTracker) start(filename string) (string, *chunkedUpload, error) {
+	file, err := os.CreateTemp("", "boardcast-upload-*")
+	if err != nil {
+		return "", nil, err
+	}
+	up := &chunkedUpload{
+		file:     file,
+		filename: filename,
+		expires:  time.Now().Add(t.ttl),
+	}
+	id := newImageID()
+	t.mu.Lock()
+	t.uploads[id] = up
+	t.mu.Unlock()
+	return id, up, nil
+}
+
+func (t *uploadTracker) get(id string) *chunkedUpload {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.uploads[id]
+}
+
+// remove drops an upload and deletes its data. The caller must hold up.mu.
+func (t *uploadTracker) remove(id string, up *chunkedUpload) {
+	t.mu.Lock()
+	delete(t.uploads, id)
+	t.mu.Unlock()
+	up.file.Close()
+	os.Remove(up.file.Name())
+}
+
+// expire periodically removes uploads that have not been touched within
+// the TTL.
+func (t *uploadTracker) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mu.Lock()
+		ids := make([]string, 0, len(t.uploads))
+		for id := range t.uploads {
+			ids = append(ids, id)
+		}
+		t.mu.Unlock()
+
+		now := time.Now()
+		for _, id := range ids {
+			up := t.get(id)
+			if up == nil {
+				continue
+			}
+			up.mu.Lock()
+			if now.After(up.expires) && t.get(id) == up {
+				t.remove(id, up)
+				log.Printf("Dropped abandoned upload %s", id)
+			}
+			up.mu.Unlock()
+		}
+	}
+}
+
+// handleChunkedUpload serves the resumable upload protocol under
+// /api/upload/:
+//
+//	POST /api/upload/init            {"filename", "mimeType"} -> {"uploadId"}
+//	PUT  /api/upload/<id>/chunk?offset=N   append the body at offset N
+//	GET  /api/upload/<id>            {"offset"}: bytes received so far
+//	POST /api/upload/<id>/complete   store the image, as POST /api/upload
+//
+// A chunk at the wrong offset gets 409 with the expected offset, so a
+// client can resume after an interruption.
+func handleChunkedUpload(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/upload/"), "/")
+		if id == "init" && action == "" {
+			handleUploadInit(hub, w, r)
+			return
+		}
+
+		up := chunkedUploads.get(id)
+		if up == nil {
+			http.Error(w, "Upload not found or expired", http.StatusNotFound)
+			return
+		}
+		up.mu.Lock()
+		defer up.mu.Unlock()
+		if chunkedUploads.get(id) != up {
+			http.Error(w, "Upload not found or expired", http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case action == "" && r.Method == "GET":
+			json.NewEncoder(w).Encode(map[string]int64{"offset": up.received})
+		case action == "chunk" && r.Method == "PUT":
+			handleUploadChunk(w, r, up)
+			up.expires = time.Now().Add(chunkedUploads.ttl)
+		case action == "complete" && r.Method == "POST":
+			data, err := io.ReadAll(io.NewSectionReader(up.file, 0, up.received))
+			chunkedUploads.remove(id, up)
+			if err != nil {
+				http.Error(w, "Failed to read upload", http.StatusInternalServerError)
+				return
+			}
+			saveUpload(hub, w, r, up.filename, data)
+		case action == "" || action == "chunk" || action == "complete":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func handleUploadInit(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if shedLoad(hub, w, r) {
+		return
+	}
+	var req struct {
+		Filename string `json:"filename"`
+		MimeType string `json:"mimeType"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	// The type is checked again from the data on completion; this only
+	// saves sending a file that would be refused.
+	if req.MimeType != "" && !allowedTypes[strings.ToLower(req.MimeType)] {
+		http.Error(w, fmt.Sprintf("Image type %s is not allowed", req.MimeType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id, _, err := chunkedUploads.start(sanitizeFilename(req.Filename))
+	if err != nil {
+		log.Printf("[%s] Failed to start upload: %v", requestID(r), err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"uploadId": id})
+}
+
+// handleUploadChunk appends r's body to up. The caller holds up.mu.
+func handleUploadChunk(w http.ResponseWriter, r *http.Request, up *chunkedUpload) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	if offset != up.received {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]int64{"offset": up.received})
+		return
+	}
+
+	n, err := io.Copy(io.NewOffsetWriter(up.file, offset), http.MaxBytesReader(w, r.Body, *uploadLimit-offset))
+	if err != nil {
+		// Keep nothing of a failed chunk; the client resends it whole.
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to write chunk", http.StatusBadRequest)
+		}
+		return
+	}
+	up.received += n
+	json.NewEncoder(w).Encode(map[string]int64{"offset": up.received})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// WebhookEvent is the JSON payload POSTed to webhook receivers.
+type WebhookEvent struct {
+	TabID       string    `json:"tabId"`
+	Name        string    `json:"name"`
+	Action      string    `json:"action"`
+	ContentHash string    `json:"contentHash"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// WebhookNotifier delivers tab change events to the configured URLs from a
+// bounded queue, so a slow receiver never blocks the hub. Events are dropped
+// when the queue is full.
+type WebhookNotifier struct {
+	urls   []string
+	secret []byte
+	queue  chan WebhookEvent
+	client *http.Client
+}
+
+func newWebhookNotifier(urls []string, secret []byte, queueSize int) *WebhookNotifier {
+	n := &WebhookNotifier{
+		urls:   urls,
+		secret: secret,
+		queue:  make(chan WebhookEvent, queueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	go n.run()
+	return n
+}
+
+// Notify queues an event for tab. It is safe to call on a nil notifier.
+func (n *WebhookNotifier) Notify(action string, tab *Tab) {
+	if n == nil {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(tab.Content))
+	ev := WebhookEvent{
+		TabID:       tab.ID,
+		Name:        tab.Name,
+		Action:      action,
+		ContentHash: hex.EncodeToString(sum[:]),
+		Timestamp:   time.Now().UTC(),
+	}
+
+	select {
+	case n.queue <- ev:
+	default:
+		log.Printf("Webhook queue full, dropping %s event for tab %s", action, tab.ID)
+	}
+}
+
+func (n *WebhookNotifier) run() {
+	for ev := range n.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+		for _, url := range n.urls {
+			if err := n.deliver(url, body); err != nil {
+				log.Printf("Webhook delivery to %s failed: %v", url, err)
+			}
+		}
+	}
+}
+
+// deliver POSTs body to url, retrying with exponential backoff. The
+// X-BoardCast-Signature header carries an HMAC-SHA256 of the body keyed with
+// the webhook secret.
+func (n *WebhookNotifier) deliver(url string, body []byte) error {
+	var err error
+	backoff := time.Second
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if len(n.secret) > 0 {
+			mac := hmac.New(sha256.New, n.secret)
+			mac.Write(body)
+			req.Header.Set("X-BoardCast-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		var resp *http.Response
+		resp, err = n.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return err
+}
@@ -5,26 +5,71 @@ interface Tab {
   id: string
   name: string
   content: string
+  language?: string
+  pinned?: boolean
+  color?: string
+  // false until the content of a tab from a metadata-only init arrives
+  loaded?: boolean
+  // the server's update count, the base for delta updates
+  version?: number
 }
 
+interface TextPatch {
+  offset: number
+  delete?: number
+  insert?: string
+}
+
+// Applies patches in order; offsets are UTF-16 code units, like JS strings
+const applyPatches = (content: string, patches: TextPatch[]) =>
+  patches.reduce((text, p) =>
+    text.slice(0, p.offset) + (p.insert || '') + text.slice(p.offset + (p.delete || 0)), content)
+
+// Pinned tabs come first; otherwise the server's order is kept.
+const pinnedFirst = (tabs: Tab[]) => [
+  ...tabs.filter(tab => tab.pinned),
+  ...tabs.filter(tab => !tab.pinned),
+]
+
 interface Message {
   type: string
   tabId?: string
   content?: string
   name?: string
+  language?: string
+  color?: string
   tabs?: Tab[]
+  token?: string
+  error?: string
+  timestamp?: number
+  presence?: Record<string, number>
+  metadata?: boolean
+  patches?: TextPatch[]
+  version?: number
+  baseVersion?: number
+  maintenance?: boolean
 }
 
 type ThemeMode = 'system' | 'light' | 'dark'
 
+interface Branding {
+  name: string
+  logoUrl?: string
+  faviconUrl?: string
+}
+
 function App() {
   const [authenticated, setAuthenticated] = useState(false)
   const [checking, setChecking] = useState(true)
   const [password, setPassword] = useState('')
   const [tabs, setTabs] = useState<Tab[]>([])
+  const [presence, setPresence] = useState<Record<string, number>>({})
   const [activeTabId, setActiveTabId] = useState<string>('default')
   const [connected, setConnected] = useState(false)
   const [error, setError] = useState('')
+  const [announcement, setAnnouncement] = useState('')
+  const [maintenance, setMaintenance] = useState(false)
+  const [branding, setBranding] = useState<Branding>({ name: 'BoardCast' })
   const [editingTabId, setEditingTabId] = useState<string | null>(null)
   const [editingTabName, setEditingTabName] = useState('')
   const [fontSize, setFontSize] = useState(() => {
@@ -43,6 +88,8 @@ function App() {
   })
   const wsRef = useRef<WebSocket | null>(null)
   const reconnectTimerRef = useRef<NodeJS.Timeout | null>(null)
+  const reconnectDelayRef = useRef(3000)
+  const latencyRef = useRef(0)
   const editorRef = useRef<any>(null)
   const updateTimerRef = useRef<NodeJS.Timeout | null>(null)
   const isLocalUpdateRef = useRef(false)
@@ -57,6 +104,24 @@ function App() {
 
   const [effectiveTheme, setEffectiveTheme] = useState(getEffectiveTheme())
 
+  useEffect(() => {
+    fetch('/api/branding')
+      .then(response => response.ok ? response.json() : null)
+      .then((brand: Branding | null) => {
+        if (!brand) return
+        setBranding(brand)
+        document.title = brand.name
+        if (brand.faviconUrl) {
+          const icon = document.querySelector<HTMLLinkElement>("link[rel='icon']")
+          if (icon) {
+            icon.removeAttribute('type')
+            icon.href = brand.faviconUrl
+          }
+        }
+      })
+      .catch(() => {})
+  }, [])
+
   useEffect(() => {
     const updateTheme = () => {
       setEffectiveTheme(getEffectiveTheme())
@@ -153,6 +218,7 @@ function App() {
     const ws = new WebSocket(`${protocol}//${window.location.host}/api/ws`)
 
     ws.onopen = () => {
+      ws.send(JSON.stringify({ type: 'hello', capabilities: ['delta'] }))
       setConnected(true)
       setError('')
       if (reconnectTimerRef.current) {
@@ -165,25 +231,69 @@ function App() {
       const msg: Message = JSON.parse(event.data)
       
       if (msg.type === 'init' && msg.tabs) {
-        setTabs(msg.tabs)
+        setTabs(msg.metadata ? msg.tabs.map(tab => ({ ...tab, loaded: false })) : msg.tabs)
+        setPresence(msg.presence || {})
+        setMaintenance(!!msg.maintenance)
         if (msg.tabs.length > 0) {
           setActiveTabId(msg.tabs[0].id)
         }
+      } else if (msg.type === 'update' && msg.tabId && msg.patches) {
+        // Delta update: patch the content this client has, or reload the
+        // tab when it missed or skipped an update
+        const patches = msg.patches
+        setTabs(prev => prev.map(tab => {
+          if (tab.id !== msg.tabId) return tab
+          if ((tab.version || 0) !== (msg.baseVersion || 0)) return { ...tab, loaded: false }
+          if (isLocalUpdateRef.current && msg.tabId === activeTabId) return { ...tab, version: msg.version }
+          return { ...tab, content: applyPatches(tab.content, patches), version: msg.version }
+        }))
       } else if (msg.type === 'update' && msg.tabId) {
         // Don't update if user is currently editing this tab
         if (!isLocalUpdateRef.current || msg.tabId !== activeTabId) {
           setTabs(prev => prev.map(tab =>
-            tab.id === msg.tabId ? { ...tab, content: msg.content || '' } : tab
+            tab.id === msg.tabId ? { ...tab, content: msg.content || '', loaded: true, version: msg.version } : tab
           ))
         }
+      } else if (msg.type === 'tab' && msg.tabs) {
+        const [loaded] = msg.tabs
+        setTabs(prev => prev.map(tab =>
+          tab.id === loaded.id ? { ...loaded, loaded: true } : tab
+        ))
+      } else if (msg.type === 'append' && msg.tabId) {
+        setTabs(prev => prev.map(tab =>
+          tab.id === msg.tabId ? { ...tab, content: tab.content + (msg.content || '') } : tab
+        ))
       } else if (msg.type === 'create' && msg.tabId && msg.name) {
-        setTabs(prev => [...prev, { id: msg.tabId, name: msg.name, content: '' }])
+        setTabs(prev => [...prev, { id: msg.tabId, name: msg.name, content: msg.content || '' }])
         setActiveTabId(msg.tabId)
+      } else if (msg.type === 'import' && msg.tabs) {
+        const imported = msg.tabs
+        setTabs(prev => pinnedFirst([...prev, ...imported]))
+      } else if (msg.type === 'set-language' && msg.tabId) {
+        setTabs(prev => prev.map(tab =>
+          tab.id === msg.tabId ? { ...tab, language: msg.language } : tab
+        ))
+      } else if (msg.type === 'set-color' && msg.tabId) {
+        setTabs(prev => prev.map(tab =>
+          tab.id === msg.tabId ? { ...tab, color: msg.color } : tab
+        ))
+      } else if (msg.type === 'move' && msg.tabs) {
+        const moved = new Map(msg.tabs.map(tab => [tab.id, tab.content]))
+        setTabs(prev => prev.map(tab =>
+          moved.has(tab.id) ? { ...tab, content: moved.get(tab.id) || '' } : tab
+        ))
+      } else if ((msg.type === 'pin' || msg.type === 'unpin') && msg.tabId) {
+        setTabs(prev => pinnedFirst(prev.map(tab =>
+          tab.id === msg.tabId ? { ...tab, pinned: msg.type === 'pin' } : tab
+        )))
       } else if (msg.type === 'rename' && msg.tabId && msg.name) {
         setTabs(prev => prev.map(tab =>
           tab.id === msg.tabId ? { ...tab, name: msg.name } : tab
         ))
-      } else if (msg.type === 'delete' && msg.tabId) {
+      } else if (msg.type === 'delete-token' && msg.tabId && msg.token) {
+        // Second step of a delete started by deleteTab
+        ws.send(JSON.stringify({ type: 'delete-confirm', tabId: msg.tabId, token: msg.token }))
+      } else if ((msg.type === 'delete' || msg.type === 'archive') && msg.tabId) {
         setTabs(prev => {
           const newTabs = prev.filter(tab => tab.id !== msg.tabId)
           if (activeTabId === msg.tabId && newTabs.length > 0) {
@@ -191,6 +301,16 @@ function App() {
           }
           return newTabs
         })
+      } else if (msg.type === 'presence') {
+        setPresence(msg.presence || {})
+      } else if (msg.type === 'maintenance') {
+        setMaintenance(!!msg.maintenance)
+      } else if (msg.type === 'announcement' && msg.content) {
+        setAnnouncement(msg.content)
+      } else if (msg.type === 'pong' && msg.timestamp) {
+        latencyRef.current = Date.now() - msg.timestamp
+      } else if ((msg.type === 'error' || msg.type === 'storage') && msg.error) {
+        alert(msg.error)
       }
     }
 
@@ -199,9 +319,22 @@ function App() {
       setConnected(false)
     }
 
-    ws.onclose = () => {
+    ws.onclose = (event) => {
       setConnected(false)
       wsRef.current = null
+      // The server may suggest when to come back, to spread out
+      // reconnects after a restart
+      const retry = /retry=(\d+)/.exec(event.reason)
+      reconnectDelayRef.current = retry ? Number(retry[1]) : 3000
+      // See the close codes in the server: 4001 and 4002 need a new
+      // login, anything else is retried
+      if (event.code === 4001) {
+        setAuthenticated(false)
+        setError('Session expired, please log in again')
+      } else if (event.code === 4002) {
+        setAuthenticated(false)
+        setError('Disconnected by an administrator')
+      }
     }
 
     wsRef.current = ws
@@ -213,7 +346,7 @@ function App() {
     if (!connected && !wsRef.current) {
       reconnectTimerRef.current = setTimeout(() => {
         connectWebSocket()
-      }, 3000)
+      }, reconnectDelayRef.current)
     }
 
     return () => {
@@ -223,6 +356,21 @@ function App() {
     }
   }, [authenticated, connected, connectWebSocket])
 
+  // Measure the round trip to the hub now and then; the last result rides
+  // along with the next ping for the server's latency stats
+  useEffect(() => {
+    if (!connected) return
+
+    const timer = setInterval(() => {
+      const ws = wsRef.current
+      if (ws?.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: 'ping', timestamp: Date.now(), latency: latencyRef.current || undefined }))
+      }
+    }, 30000)
+
+    return () => clearInterval(timer)
+  }, [connected])
+
   useEffect(() => {
     if (authenticated && !wsRef.current) {
       connectWebSocket()
@@ -338,10 +486,15 @@ function App() {
   const createNewTab = () => {
     if (wsRef.current?.readyState === WebSocket.OPEN) {
       const newId = `tab-${Date.now()}`
+      const names = new Set(tabs.map(tab => tab.name.toLowerCase()))
+      let n = tabs.length + 1
+      while (names.has(`tab ${n}`)) {
+        n++
+      }
       const msg: Message = {
         type: 'create',
         tabId: newId,
-        name: `Tab ${tabs.length + 1}`,
+        name: `Tab ${n}`,
       }
       wsRef.current.send(JSON.stringify(msg))
     } else {
@@ -362,6 +515,16 @@ function App() {
     setEditingTabName('')
   }
 
+  const togglePin = (tab: Tab) => {
+    if (wsRef.current?.readyState === WebSocket.OPEN) {
+      const msg: Message = {
+        type: tab.pinned ? 'unpin' : 'pin',
+        tabId: tab.id,
+      }
+      wsRef.current.send(JSON.stringify(msg))
+    }
+  }
+
   const deleteTab = (tabId: string) => {
     if (tabs.length <= 1) {
       alert('Cannot delete the last tab')
@@ -369,13 +532,33 @@ function App() {
     }
     if (wsRef.current?.readyState === WebSocket.OPEN) {
       const msg: Message = {
-        type: 'delete',
+        type: 'delete-request',
         tabId: tabId,
       }
       wsRef.current.send(JSON.stringify(msg))
     }
   }
 
+  // Tell the server which tab this client is looking at, for viewer lists
+  useEffect(() => {
+    const ws = wsRef.current
+    if (!connected || ws?.readyState !== WebSocket.OPEN) return
+    ws.send(JSON.stringify({ type: 'subscribe', tabId: activeTabId }))
+    return () => {
+      if (ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: 'unsubscribe', tabId: activeTabId }))
+      }
+    }
+  }, [activeTabId, connected])
+
+  // After a metadata-only init, fetch each tab's content when it is shown
+  const activeUnloaded = tabs.find(tab => tab.id === activeTabId)?.loaded === false
+  useEffect(() => {
+    const ws = wsRef.current
+    if (!activeUnloaded || !connected || ws?.readyState !== WebSocket.OPEN) return
+    ws.send(JSON.stringify({ type: 'get', tabId: activeTabId }))
+  }, [activeTabId, activeUnloaded, connected])
+
   useEffect(() => {
     checkAuth()
   }, [checkAuth])
@@ -393,7 +576,8 @@ function App() {
       <div className="min-h-screen bg-gradient-to-br from-blue-50 to-indigo-100 flex items-center justify-center p-4">
         <div className="bg-white rounded-2xl shadow-xl p-8 w-full max-w-md">
           <div className="text-center mb-8">
-            <h1 className="text-4xl font-bold text-gray-800 mb-2">BoardCast</h1>
+            {branding.logoUrl && <img src={branding.logoUrl} alt="" className="h-16 mx-auto mb-4" />}
+            <h1 className="text-4xl font-bold text-gray-800 mb-2">{branding.name}</h1>
             <p className="text-gray-600">Real-time collaborative whiteboard</p>
           </div>
           
@@ -457,7 +641,8 @@ function App() {
             </svg>
           </button>
           
-          <h1 className={`text-lg md:text-xl font-bold ${effectiveTheme === 'dark' ? 'text-gray-100' : 'text-gray-800'}`}>BoardCast</h1>
+          {branding.logoUrl && <img src={branding.logoUrl} alt="" className="h-6 md:h-8" />}
+          <h1 className={`text-lg md:text-xl font-bold ${effectiveTheme === 'dark' ? 'text-gray-100' : 'text-gray-800'}`}>{branding.name}</h1>
           
           <div className="hidden sm:flex items-center space-x-2">
             <div className={`w-2 h-2 rounded-full ${connected ? 'bg-green-500' : 'bg-red-500'}`} />
@@ -524,6 +709,29 @@ function App() {
         </div>
       </div>
 
+      {/* Maintenance Banner */}
+      {maintenance && (
+        <div className="bg-red-100 border-b border-red-300 text-red-900 px-4 py-2 text-sm">
+          Read-only: the board is under maintenance. Changes are disabled until it ends.
+        </div>
+      )}
+
+      {/* Announcement Banner */}
+      {announcement && (
+        <div className="bg-amber-100 border-b border-amber-300 text-amber-900 px-4 py-2 flex items-center justify-between text-sm">
+          <span>{announcement}</span>
+          <button
+            onClick={() => setAnnouncement('')}
+            className="p-1 rounded hover:bg-amber-200"
+            title="Dismiss"
+          >
+            <svg className="w-4 h-4" fill="none" stroke="currentColor" viewBox="0 0 24 24">
+              <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M6 18L18 6M6 6l12 12" />
+            </svg>
+          </button>
+        </div>
+      )}
+
       {/* Main Content */}
       <div className="flex-1 flex flex-col overflow-hidden">
         <div className="flex-1 flex overflow-hidden">
@@ -574,12 +782,32 @@ function App() {
                         />
                       ) : (
                         <div className="flex items-center justify-between">
-                          <span className={`text-sm font-medium truncate ${
+                          <span className={`flex items-center text-sm font-medium truncate ${
                             effectiveTheme === 'dark' ? 'text-gray-200' : 'text-gray-800'
                           }`}>
+                            {tab.color && (
+                              <span className="w-2 h-2 mr-2 rounded-full flex-shrink-0" style={{ backgroundColor: tab.color }} />
+                            )}
                             {tab.name}
+                            {presence[tab.id] > 0 && (
+                              <span className="ml-2 text-xs text-gray-500" title="People viewing this tab">
+                                {presence[tab.id]}
+                              </span>
+                            )}
                           </span>
-                          <div className="flex space-x-1 opacity-0 group-hover:opacity-100 transition">
+                          <div className={`flex space-x-1 transition ${tab.pinned ? '' : 'opacity-0 group-hover:opacity-100'}`}>
+                            <button
+                              onClick={(e) => {
+                                e.stopPropagation()
+                                togglePin(tab)
+                              }}
+                              className={`p-1 rounded ${tab.pinned ? 'text-blue-600' : 'text-gray-600 hover:text-blue-600'}`}
+                              title={tab.pinned ? 'Unpin' : 'Pin'}
+                            >
+                              <svg className="w-4 h-4" fill={tab.pinned ? 'currentColor' : 'none'} stroke="currentColor" viewBox="0 0 24 24">
+                                <path strokeLinecap="round" strokeLinejoin="round" strokeWidth={2} d="M5 5a2 2 0 012-2h10a2 2 0 012 2v16l-7-3.5L5 21V5z" />
+                              </svg>
+                            </button>
                             <button
                               onClick={(e) => {
                                 e.stopPropagation()
@@ -622,12 +850,13 @@ function App() {
             <Editor
               key={activeTabId}
               height="100%"
-              defaultLanguage="markdown"
+              language={activeTab?.language || 'markdown'}
               value={activeTab?.content || ''}
               onChange={handleEditorChange}
               theme={effectiveTheme === 'dark' ? 'vs-dark' : 'vs-light'}
               options={{
                 fontSize: fontSize,
+                readOnly: maintenance || activeTab?.loaded === false,
                 wordWrap: 'on',
                 minimap: { enabled: false },
                 lineNumbers: 'on',